@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/shadow1163/nes-go/step5/nes"
+)
+
+// cheatEntry is a cheat as kept in the cheat file
+type cheatEntry struct {
+	Code        string `json:"code"`
+	Description string `json:"description"`
+	Enabled     bool   `json:"enabled"`
+}
+
+// cheats are the cheats of the loaded ROM
+var cheats []cheatEntry
+
+// cheatsPath returns the cheat file, next to the config file. It maps ROM
+// SHA-1 hashes to their cheats.
+func cheatsPath() (string, error) {
+	path, err := configPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(path), "cheats.json"), nil
+}
+
+// loadCheatFile read the cheats of every ROM
+func loadCheatFile() (map[string][]cheatEntry, error) {
+	all := map[string][]cheatEntry{}
+	path, err := cheatsPath()
+	if err != nil {
+		return all, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return all, nil
+	} else if err != nil {
+		return all, err
+	}
+	err = json.Unmarshal(data, &all)
+	return all, err
+}
+
+// loadCheats read the cheats of a ROM
+func loadCheats(sha1 string) error {
+	all, err := loadCheatFile()
+	cheats = all[sha1]
+	return err
+}
+
+// saveCheats store the cheats of a ROM, keeping the other ROMs'
+func saveCheats(sha1 string) error {
+	all, err := loadCheatFile()
+	if err != nil {
+		return err
+	}
+	if len(cheats) == 0 {
+		delete(all, sha1)
+	} else {
+		all[sha1] = cheats
+	}
+	path, err := cheatsPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(all, "", "  ")
+	if err != nil {
+		return err
+	}
+	return nes.WriteFileAtomic(path, data)
+}
+
+// enabledCheats decode the enabled cheats. Codes were validated when they
+// were added, a bad one in a hand edited file is skipped.
+func enabledCheats() []*nes.Cheat {
+	var list []*nes.Cheat
+	for _, entry := range cheats {
+		if !entry.Enabled {
+			continue
+		}
+		cheat, err := nes.ParseCheat(entry.Code)
+		if err != nil {
+			log.Warning(err)
+			continue
+		}
+		list = append(list, cheat)
+	}
+	return list
+}
+
+// cheatHandler list the cheats of the ROM as JSON, or change them with a
+// POST of action=add with code and description, action=toggle or
+// action=remove with index
+func cheatHandler(w http.ResponseWriter, r *http.Request) {
+	emu.Lock()
+	defer emu.Unlock()
+	if r.Method == http.MethodPost {
+		index, _ := strconv.Atoi(r.FormValue("index"))
+		switch action := r.FormValue("action"); {
+		case action == "add":
+			if _, err := nes.ParseCheat(r.FormValue("code")); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			cheats = append(cheats, cheatEntry{r.FormValue("code"), r.FormValue("description"), true})
+		case index < 0 || index >= len(cheats):
+			http.Error(w, fmt.Sprintf("no cheat %q", r.FormValue("index")), http.StatusBadRequest)
+			return
+		case action == "toggle":
+			cheats[index].Enabled = !cheats[index].Enabled
+		case action == "remove":
+			cheats = append(cheats[:index], cheats[index+1:]...)
+		default:
+			http.Error(w, fmt.Sprintf("unknown cheat action %q", action), http.StatusBadRequest)
+			return
+		}
+		emu.console.SetCheats(enabledCheats())
+		if err := saveCheats(cart.SHA1); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	list := cheats
+	if list == nil {
+		list = []cheatEntry{}
+	}
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// playerKeys maps the buttons of one controller to browser key codes,
+// 0 leaves a button unbound
+type playerKeys struct {
+	A      int `json:"a"`
+	B      int `json:"b"`
+	Select int `json:"select"`
+	Start  int `json:"start"`
+	Up     int `json:"up"`
+	Down   int `json:"down"`
+	Left   int `json:"left"`
+	Right  int `json:"right"`
+	TurboA int `json:"turbo_a"`
+	TurboB int `json:"turbo_b"`
+}
+
+// hotkeys maps frontend actions to browser key codes
+type hotkeys struct {
+	Reset        int `json:"reset"`
+	Pause        int `json:"pause"`
+	FrameAdvance int `json:"frame_advance"`
+	SpeedUp      int `json:"speed_up"`
+	SpeedDown    int `json:"speed_down"`
+	Turbo        int `json:"turbo"`
+	SaveState    int `json:"save_state"`
+	LoadState    int `json:"load_state"`
+	NextSlot     int `json:"next_slot"`
+	FastForward  int `json:"fast_forward"`
+	Rewind       int `json:"rewind"`
+	Screenshot   int `json:"screenshot"`
+	Record       int `json:"record"`
+	Quit         int `json:"quit"`
+}
+
+// gamepadMapping maps the buttons of one controller to browser Gamepad API
+// button indexes, -1 leaves a button unbound. The analog stick is read as
+// a D-pad once it leaves the deadzone.
+type gamepadMapping struct {
+	Pad      int     `json:"pad"` // navigator.getGamepads() index, -1 for none
+	A        int     `json:"a"`
+	B        int     `json:"b"`
+	Select   int     `json:"select"`
+	Start    int     `json:"start"`
+	Up       int     `json:"up"`
+	Down     int     `json:"down"`
+	Left     int     `json:"left"`
+	Right    int     `json:"right"`
+	TurboA   int     `json:"turbo_a"`
+	TurboB   int     `json:"turbo_b"`
+	AxisX    int     `json:"axis_x"`
+	AxisY    int     `json:"axis_y"`
+	Deadzone float64 `json:"deadzone"`
+}
+
+// config is the frontend configuration stored in the user config dir
+type config struct {
+	Players [2]playerKeys `json:"players"`
+	Hotkeys hotkeys       `json:"hotkeys"`
+	// Gamepads are the USB controller mappings for player 1 and 2.
+	Gamepads [2]gamepadMapping `json:"gamepads"`
+	// TurboRate is the number of frames a turbo button stays pressed, then
+	// released.
+	TurboRate int `json:"turbo_rate"`
+}
+
+// defaultConfig puts player 1 on the arrows and x/z, player 2 on the keypad
+func defaultConfig() *config {
+	return &config{
+		Players: [2]playerKeys{
+			{A: 88, B: 90, Select: 16, Start: 13, Up: 38, Down: 40, Left: 37, Right: 39, TurboA: 83, TurboB: 65},
+			{A: 99, B: 97, Select: 110, Start: 96, Up: 104, Down: 98, Left: 100, Right: 102, TurboA: 105, TurboB: 103},
+		},
+		Hotkeys: hotkeys{
+			Reset:        82,  // r
+			Pause:        80,  // p
+			FrameAdvance: 220, // backslash
+			SpeedUp:      187, // =
+			SpeedDown:    189, // -
+			Turbo:        192, // backquote
+			SaveState:    113, // F2
+			NextSlot:     114, // F3
+			LoadState:    115, // F4
+			FastForward:  9,   // tab
+			Rewind:       8,   // backspace
+			Screenshot:   123, // F12
+			Record:       120, // F9
+			Quit:         81,  // q
+		},
+		Gamepads: [2]gamepadMapping{
+			defaultGamepad(0),
+			defaultGamepad(1),
+		},
+		TurboRate: 2,
+	}
+}
+
+// defaultGamepad uses the standard Gamepad API layout: the bottom face
+// button is B, the right one A, and the left stick doubles the D-pad
+func defaultGamepad(pad int) gamepadMapping {
+	return gamepadMapping{
+		Pad: pad, A: 1, B: 0, Select: 8, Start: 9,
+		Up: 12, Down: 13, Left: 14, Right: 15, TurboA: 3, TurboB: 2,
+		AxisX: 0, AxisY: 1, Deadzone: 0.5,
+	}
+}
+
+// configPath returns the config file location, e.g. ~/.config/nes-go/config.json
+func configPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "nes-go", "config.json"), nil
+}
+
+// loadConfig read the config file, falling back to the defaults for a
+// missing file or missing settings
+func loadConfig() (*config, error) {
+	conf := defaultConfig()
+	path, err := configPath()
+	if err != nil {
+		return conf, err
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return conf, nil
+	} else if err != nil {
+		return conf, err
+	}
+	if err := json.Unmarshal(data, conf); err != nil {
+		return defaultConfig(), err
+	}
+	if conf.TurboRate < 1 {
+		conf.TurboRate = 1
+	}
+	return conf, nil
+}
+
+// saveConfig write the config file
+func saveConfig(conf *config) error {
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(conf, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
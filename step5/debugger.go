@@ -0,0 +1,469 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/shadow1163/nes-go/step5/nes"
+)
+
+// disassemblyLines are the instructions shown before and after PC
+const disassemblyLines = 10
+
+// traceShown is how many tracepoint lines the debugger panel shows
+const traceShown = 50
+
+// debugWatches are the watch expressions of the debugger panel
+var debugWatches []*nes.Expr
+
+// parseRange parse an address or an ADDRESS-END range
+func parseRange(s string) (uint16, uint16, error) {
+	first, last := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		first, last = s[:i], s[i+1:]
+	}
+	address, err := parseNumber(first, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad address %q", first)
+	}
+	end, err := parseNumber(last, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad address %q", last)
+	}
+	return uint16(address), uint16(end), nil
+}
+
+// debugLine is a disassembly line of the debugger panel
+type debugLine struct {
+	Address    uint16 `json:"address"`
+	Text       string `json:"text"`
+	Current    bool   `json:"current"`
+	Breakpoint bool   `json:"breakpoint"`
+}
+
+// debugStatus is the state shown by the debugger panel
+type debugStatus struct {
+	Paused      bool              `json:"paused"`
+	Reason      string            `json:"reason"`
+	Frame       int               `json:"frame"`
+	Registers   map[string]uint16 `json:"registers"`
+	Disassembly []debugLine       `json:"disassembly"`
+	Breakpoints []*nes.Breakpoint `json:"breakpoints"`
+	Watches     []watchedExpr     `json:"watches"`
+	Trace       []string          `json:"trace"`
+}
+
+// watchedExpr is a watch expression with its value
+type watchedExpr struct {
+	Expression string `json:"expression"`
+	Value      int    `json:"value"`
+}
+
+// debugHandler return the debugger state as JSON, or control it with a
+// POST of action: break, continue, into, over, out, runto with address,
+// add with kind (letters x, r and w), address, an address or a range, an
+// optional condition and trace=true for a tracepoint, toggle or remove
+// with id, condition with id and condition, ignore with id and count, set
+// with register and value, watch with expression, unwatch with index. The
+// debugger is attached on the first request.
+func debugHandler(w http.ResponseWriter, r *http.Request) {
+	emu.Lock()
+	defer emu.Unlock()
+	d := emu.console.Debugger()
+	if r.Method == http.MethodPost {
+		if err := debugAction(d, r); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	cpu := emu.console.CPU
+	paused, reason := d.Paused()
+	status := debugStatus{
+		Paused: paused,
+		Reason: reason,
+		Frame:  emu.console.Frame,
+		Registers: map[string]uint16{
+			"PC": cpu.PC, "A": uint16(cpu.A), "X": uint16(cpu.X), "Y": uint16(cpu.Y),
+			"P": uint16(cpu.Flags()), "SP": uint16(cpu.SP),
+		},
+		Breakpoints: d.Breakpoints,
+	}
+	for _, i := range emu.console.DisassembleAround(cpu.PC, disassemblyLines, disassemblyLines) {
+		line := debugLine{Address: i.Address, Text: i.String(), Current: i.Address == cpu.PC}
+		for _, bp := range d.Breakpoints {
+			line.Breakpoint = line.Breakpoint || bp.Kind&nes.BreakExecute != 0 && i.Address >= bp.Address && i.Address <= bp.End
+		}
+		status.Disassembly = append(status.Disassembly, line)
+	}
+	if status.Breakpoints == nil {
+		status.Breakpoints = []*nes.Breakpoint{}
+	}
+	status.Watches = []watchedExpr{}
+	for _, expr := range debugWatches {
+		status.Watches = append(status.Watches, watchedExpr{expr.Source, expr.Eval(emu.console)})
+	}
+	status.Trace = d.Trace()
+	if len(status.Trace) > traceShown {
+		status.Trace = status.Trace[len(status.Trace)-traceShown:]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// debugAction run a debugger panel action. Running or stepping also ends
+// a pause of the emulator, or nothing would run.
+func debugAction(d *nes.Debugger, r *http.Request) error {
+	switch action := r.FormValue("action"); action {
+	case "break":
+		d.Break()
+	case "continue":
+		d.Continue()
+		emu.paused = false
+	case "into":
+		d.StepInto()
+		emu.paused = false
+	case "over":
+		d.StepOver()
+		emu.paused = false
+	case "out":
+		d.StepOut()
+		emu.paused = false
+	case "runto":
+		address, err := parseNumber(r.FormValue("address"), 16)
+		if err != nil {
+			return fmt.Errorf("bad address %q", r.FormValue("address"))
+		}
+		d.RunTo(uint16(address))
+		emu.paused = false
+	case "add":
+		kind, err := nes.ParseBreakKind(r.FormValue("kind"))
+		if err != nil {
+			return err
+		}
+		address, end, err := parseRange(r.FormValue("address"))
+		if err != nil {
+			return err
+		}
+		return addBreakpoint(d, kind, address, end, r.FormValue("condition"), r.FormValue("trace") == "true")
+	case "toggle", "remove", "condition", "ignore":
+		id, _ := strconv.Atoi(r.FormValue("id"))
+		bp, err := d.Breakpoint(id)
+		if err != nil {
+			return err
+		}
+		switch action {
+		case "remove":
+			return d.RemoveBreakpoint(id)
+		case "condition":
+			return bp.SetCondition(r.FormValue("condition"))
+		case "ignore":
+			count, err := strconv.Atoi(r.FormValue("count"))
+			if err != nil || count < 0 {
+				return fmt.Errorf("bad ignore count %q", r.FormValue("count"))
+			}
+			bp.Ignore = count
+		default:
+			bp.Enabled = !bp.Enabled
+		}
+	case "watch":
+		expr, err := nes.ParseExpr(r.FormValue("expression"))
+		if err != nil {
+			return err
+		}
+		debugWatches = append(debugWatches, expr)
+	case "unwatch":
+		index, _ := strconv.Atoi(r.FormValue("index"))
+		if index < 0 || index >= len(debugWatches) {
+			return fmt.Errorf("no watch %q", r.FormValue("index"))
+		}
+		debugWatches = append(debugWatches[:index], debugWatches[index+1:]...)
+	case "set":
+		value, err := parseNumber(r.FormValue("value"), 16)
+		if err != nil {
+			return fmt.Errorf("bad value %q", r.FormValue("value"))
+		}
+		return d.SetRegister(r.FormValue("register"), uint16(value))
+	default:
+		return fmt.Errorf("unknown debugger action %q", action)
+	}
+	return nil
+}
+
+// addBreakpoint add a breakpoint or tracepoint with an optional condition
+func addBreakpoint(d *nes.Debugger, kind nes.BreakKind, address, end uint16, condition string, trace bool) error {
+	bp, err := d.AddBreakpoint(kind, address, end)
+	if err != nil {
+		return err
+	}
+	bp.Trace = trace
+	if err := bp.SetCondition(condition); err != nil {
+		d.RemoveBreakpoint(bp.ID)
+		return err
+	}
+	return nil
+}
+
+// debugREPL is the debugger prompt of "nes run -debug"
+type debugREPL struct {
+	console *nes.Console
+	in      *bufio.Scanner
+	out     io.Writer
+	steps   int // single steps left to run without prompting
+	watches []*nes.Expr
+}
+
+const debugHelp = `commands, addresses are decimal, 0x or $ prefixed hex:
+  c                       continue
+  s [N]                   step into, N instructions
+  n                       step over
+  o                       step out
+  u ADDRESS               run until ADDRESS
+  b ADDRESS[-END] [xrw] [if CONDITION]
+                          add a breakpoint, execution by default
+  tp ADDRESS[-END] [xrw] [if CONDITION]
+                          add a tracepoint, which prints its hits
+  cond ID [CONDITION]     change or remove the condition of breakpoint ID
+  ignore ID N             ignore the next N hits of breakpoint ID
+  t ID                    toggle breakpoint ID
+  d ID                    delete breakpoint ID
+  bl                      list breakpoints
+  p EXPRESSION            print an expression, such as A == $40 && [$0300] > 3
+  w EXPRESSION            watch an expression, printed at every stop
+  uw N                    remove watch N
+  r                       show registers
+  set REGISTER VALUE      change a register or flag
+  l [ADDRESS]             disassemble, around PC by default
+  m ADDRESS [LENGTH]      dump memory
+  q                       quit`
+
+// prompt read commands while the console is stopped, until one runs it
+// again. It returns false to quit.
+func (repl *debugREPL) prompt() bool {
+	d := repl.console.Debugger()
+	_, reason := d.Paused()
+	if repl.steps > 0 && reason == "step" {
+		repl.steps--
+		d.StepInto()
+		return true
+	}
+	repl.steps = 0
+	fmt.Fprintf(repl.out, "%s at frame %d\n", reason, repl.console.Frame)
+	repl.where()
+	for {
+		fmt.Fprint(repl.out, "(nes) ")
+		if !repl.in.Scan() {
+			fmt.Fprintln(repl.out)
+			return false
+		}
+		fields := strings.Fields(repl.in.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		run, err := repl.command(d, fields[0], fields[1:])
+		if err != nil {
+			fmt.Fprintln(repl.out, err)
+			continue
+		}
+		if fields[0] == "q" {
+			return false
+		}
+		if run {
+			return true
+		}
+	}
+}
+
+// where show the registers, the instruction at PC and the watches
+func (repl *debugREPL) where() {
+	fmt.Fprintln(repl.out, repl.console.Disassemble(repl.console.CPU.PC))
+	fmt.Fprintln(repl.out, repl.console.Debugger().Registers())
+	for i, expr := range repl.watches {
+		value := expr.Eval(repl.console)
+		fmt.Fprintf(repl.out, "%d: %s = %d ($%X)\n", i, expr, value, value)
+	}
+}
+
+// command run a prompt command, it returns whether the console runs again
+func (repl *debugREPL) command(d *nes.Debugger, name string, args []string) (bool, error) {
+	address := func(i int) (uint16, error) {
+		if i >= len(args) {
+			return 0, fmt.Errorf("%s needs an address", name)
+		}
+		a, err := parseNumber(args[i], 16)
+		if err != nil {
+			return 0, fmt.Errorf("bad address %q", args[i])
+		}
+		return uint16(a), nil
+	}
+	id := func() (int, error) {
+		if len(args) < 1 {
+			return 0, fmt.Errorf("%s needs a breakpoint id", name)
+		}
+		return strconv.Atoi(strings.TrimPrefix(args[0], "#"))
+	}
+	switch name {
+	case "c":
+		d.Continue()
+		return true, nil
+	case "s":
+		n := 1
+		if len(args) > 0 {
+			var err error
+			if n, err = strconv.Atoi(args[0]); err != nil || n < 1 {
+				return false, fmt.Errorf("bad step count %q", args[0])
+			}
+		}
+		repl.steps = n - 1
+		d.StepInto()
+		return true, nil
+	case "n":
+		d.StepOver()
+		return true, nil
+	case "o":
+		d.StepOut()
+		return true, nil
+	case "u":
+		a, err := address(0)
+		if err != nil {
+			return false, err
+		}
+		d.RunTo(a)
+		return true, nil
+	case "b", "tp":
+		if len(args) < 1 {
+			return false, fmt.Errorf("%s needs an address", name)
+		}
+		first, end, err := parseRange(args[0])
+		if err != nil {
+			return false, err
+		}
+		var condition string
+		for i, arg := range args {
+			if arg == "if" {
+				condition = strings.Join(args[i+1:], " ")
+				args = args[:i]
+				break
+			}
+		}
+		kind := nes.BreakExecute
+		if len(args) > 1 {
+			if kind, err = nes.ParseBreakKind(args[1]); err != nil {
+				return false, err
+			}
+		}
+		if err := addBreakpoint(d, kind, first, end, condition, name == "tp"); err != nil {
+			return false, err
+		}
+		fmt.Fprintln(repl.out, d.Breakpoints[len(d.Breakpoints)-1])
+	case "t", "d", "cond", "ignore":
+		n, err := id()
+		if err != nil {
+			return false, err
+		}
+		bp, err := d.Breakpoint(n)
+		if err != nil {
+			return false, err
+		}
+		switch name {
+		case "d":
+			return false, d.RemoveBreakpoint(n)
+		case "cond":
+			if err := bp.SetCondition(strings.Join(args[1:], " ")); err != nil {
+				return false, err
+			}
+		case "ignore":
+			count := -1
+			if len(args) == 2 {
+				count, _ = strconv.Atoi(args[1])
+			}
+			if count < 0 {
+				return false, fmt.Errorf("usage: ignore ID N")
+			}
+			bp.Ignore = count
+		default:
+			bp.Enabled = !bp.Enabled
+		}
+		fmt.Fprintln(repl.out, bp)
+	case "p", "w":
+		expr, err := nes.ParseExpr(strings.Join(args, " "))
+		if err != nil {
+			return false, err
+		}
+		if name == "w" {
+			repl.watches = append(repl.watches, expr)
+		}
+		value := expr.Eval(repl.console)
+		fmt.Fprintf(repl.out, "%s = %d ($%X)\n", expr, value, value)
+	case "uw":
+		n := -1
+		if len(args) == 1 {
+			n, _ = strconv.Atoi(args[0])
+		}
+		if n < 0 || n >= len(repl.watches) {
+			return false, fmt.Errorf("usage: uw N, with N a watch number")
+		}
+		repl.watches = append(repl.watches[:n], repl.watches[n+1:]...)
+	case "bl":
+		for _, bp := range d.Breakpoints {
+			fmt.Fprintln(repl.out, bp)
+		}
+	case "r":
+		repl.where()
+	case "set":
+		if len(args) != 2 {
+			return false, fmt.Errorf("usage: set REGISTER VALUE")
+		}
+		v, err := parseNumber(args[1], 16)
+		if err != nil {
+			return false, fmt.Errorf("bad value %q", args[1])
+		}
+		if err := d.SetRegister(args[0], uint16(v)); err != nil {
+			return false, err
+		}
+		repl.where()
+	case "l":
+		a := repl.console.CPU.PC
+		if len(args) > 0 {
+			var err error
+			if a, err = address(0); err != nil {
+				return false, err
+			}
+		}
+		for _, i := range repl.console.DisassembleAround(a, disassemblyLines/2, disassemblyLines) {
+			marker := "  "
+			if i.Address == repl.console.CPU.PC {
+				marker = "> "
+			}
+			fmt.Fprintln(repl.out, marker+i.String())
+		}
+	case "m":
+		a, err := address(0)
+		if err != nil {
+			return false, err
+		}
+		n := uint64(64)
+		if len(args) > 1 {
+			if n, err = parseNumber(args[1], 16); err != nil {
+				return false, fmt.Errorf("bad length %q", args[1])
+			}
+		}
+		for row := uint64(0); row < n; row += 16 {
+			fmt.Fprintf(repl.out, "%04X ", a+uint16(row))
+			for i := row; i < row+16 && i < n; i++ {
+				fmt.Fprintf(repl.out, " %02X", repl.console.Peek(a+uint16(i)))
+			}
+			fmt.Fprintln(repl.out)
+		}
+	case "q":
+	case "h", "help":
+		fmt.Fprintln(repl.out, debugHelp)
+	default:
+		return false, fmt.Errorf("unknown command %q, h for help", name)
+	}
+	return false, nil
+}
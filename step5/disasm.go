@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/shadow1163/nes-go/step5/disasm"
+)
+
+// runDisasm implement "nes disasm": list a PRG bank of a ROM in assembler
+// syntax. Code is found by following it from the vectors and the -start
+// addresses, the rest is listed as data. It returns the exit status.
+func runDisasm(args []string) int {
+	flags := flag.NewFlagSet("disasm", flag.ExitOnError)
+	rom := addROMFlags(flags)
+	bank := flags.Int("bank", -1, "16KB PRG bank to list, -1 for the last one")
+	org := flags.String("org", "", "address the bank is mapped at, default $C000 for the last bank and $8000 otherwise")
+	start := flags.String("start", "", "comma separated addresses to follow code from, besides the vectors")
+	linear := flags.Bool("linear", false, "decode every byte as code instead of following it")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: nes disasm [flags] FILENAME.ROM")
+		flags.PrintDefaults()
+	}
+	names, err := parseFlags(flags, args)
+	if err != nil || len(names) != 1 {
+		flags.Usage()
+		return 1
+	}
+	romFile := names[0]
+
+	cart, err := rom.load(romFile, false)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	if len(cart.PRG) == 0 {
+		log.Error("ROM has no PRG-ROM banks")
+		return 1
+	}
+	if *bank == -1 {
+		*bank = len(cart.PRG) - 1
+	}
+	if *bank < 0 || *bank >= len(cart.PRG) {
+		log.Error(fmt.Sprintf("bank %d is out of range, the ROM has %d", *bank, len(cart.PRG)))
+		return 1
+	}
+	address := uint64(0x8000)
+	if *bank == len(cart.PRG)-1 {
+		address = 0xC000
+	}
+	if *org != "" {
+		if address, err = parseNumber(*org, 16); err != nil {
+			log.Error(fmt.Sprintf("bad origin %q", *org))
+			return 1
+		}
+	}
+	data := cart.PRG[*bank]
+	if address+uint64(len(data)) > 0x10000 {
+		data = data[:0x10000-address]
+	}
+	listing := disasm.NewListing(data, uint16(address))
+
+	entries := listing.Entries()
+	if *start != "" {
+		for _, field := range strings.Split(*start, ",") {
+			entry, err := parseNumber(field, 16)
+			if err != nil {
+				log.Error(fmt.Sprintf("bad start address %q", field))
+				return 1
+			}
+			entries = append(entries, uint16(entry))
+		}
+	}
+
+	fmt.Printf("; %s bank %d, $%04X-$%04X\n", romFile, *bank, address, address+uint64(len(data))-1)
+	if !*linear && len(entries) == 0 {
+		fmt.Println("; no vectors or -start addresses in the bank, decoding linearly")
+		*linear = true
+	}
+	if *linear {
+		listing.Linear()
+	} else {
+		listing.Follow(entries...)
+	}
+	if _, err := listing.WriteTo(os.Stdout); err != nil {
+		log.Error(err)
+		return 1
+	}
+	return 0
+}
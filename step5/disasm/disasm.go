@@ -0,0 +1,211 @@
+package disasm
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Addressing modes, as found in Modes
+const (
+	_ = iota
+	Absolute
+	AbsoluteX
+	AbsoluteY
+	Accumulator
+	Immediate
+	Implied
+	IndexedIndirect
+	Indirect
+	IndirectIndexed
+	Relative
+	ZeroPage
+	ZeroPageX
+	ZeroPageY
+)
+
+// Modes indicates the addressing mode for each instruction
+var Modes = [256]byte{
+	6, 7, 6, 7, 11, 11, 11, 11, 6, 5, 4, 5, 1, 1, 1, 1,
+	10, 9, 6, 9, 12, 12, 12, 12, 6, 3, 6, 3, 2, 2, 2, 2,
+	1, 7, 6, 7, 11, 11, 11, 11, 6, 5, 4, 5, 1, 1, 1, 1,
+	10, 9, 6, 9, 12, 12, 12, 12, 6, 3, 6, 3, 2, 2, 2, 2,
+	6, 7, 6, 7, 11, 11, 11, 11, 6, 5, 4, 5, 1, 1, 1, 1,
+	10, 9, 6, 9, 12, 12, 12, 12, 6, 3, 6, 3, 2, 2, 2, 2,
+	6, 7, 6, 7, 11, 11, 11, 11, 6, 5, 4, 5, 8, 1, 1, 1,
+	10, 9, 6, 9, 12, 12, 12, 12, 6, 3, 6, 3, 2, 2, 2, 2,
+	5, 7, 5, 7, 11, 11, 11, 11, 6, 5, 6, 5, 1, 1, 1, 1,
+	10, 9, 6, 9, 12, 12, 13, 13, 6, 3, 6, 3, 2, 2, 3, 3,
+	5, 7, 5, 7, 11, 11, 11, 11, 6, 5, 6, 5, 1, 1, 1, 1,
+	10, 9, 6, 9, 12, 12, 13, 13, 6, 3, 6, 3, 2, 2, 3, 3,
+	5, 7, 5, 7, 11, 11, 11, 11, 6, 5, 6, 5, 1, 1, 1, 1,
+	10, 9, 6, 9, 12, 12, 12, 12, 6, 3, 6, 3, 2, 2, 2, 2,
+	5, 7, 5, 7, 11, 11, 11, 11, 6, 5, 6, 5, 1, 1, 1, 1,
+	10, 9, 6, 9, 12, 12, 12, 12, 6, 3, 6, 3, 2, 2, 2, 2,
+}
+
+// Sizes indicates the size of each instruction in bytes, 0 for the
+// unofficial opcodes the CPU does not emulate
+var Sizes = [256]byte{
+	2, 2, 0, 0, 2, 2, 2, 0, 1, 2, 1, 0, 3, 3, 3, 0,
+	2, 2, 0, 0, 2, 2, 2, 0, 1, 3, 1, 0, 3, 3, 3, 0,
+	3, 2, 0, 0, 2, 2, 2, 0, 1, 2, 1, 0, 3, 3, 3, 0,
+	2, 2, 0, 0, 2, 2, 2, 0, 1, 3, 1, 0, 3, 3, 3, 0,
+	1, 2, 0, 0, 2, 2, 2, 0, 1, 2, 1, 0, 3, 3, 3, 0,
+	2, 2, 0, 0, 2, 2, 2, 0, 1, 3, 1, 0, 3, 3, 3, 0,
+	1, 2, 0, 0, 2, 2, 2, 0, 1, 2, 1, 0, 3, 3, 3, 0,
+	2, 2, 0, 0, 2, 2, 2, 0, 1, 3, 1, 0, 3, 3, 3, 0,
+	2, 2, 0, 0, 2, 2, 2, 0, 1, 0, 1, 0, 3, 3, 3, 0,
+	2, 2, 0, 0, 2, 2, 2, 0, 1, 3, 1, 0, 0, 3, 0, 0,
+	2, 2, 2, 0, 2, 2, 2, 0, 1, 2, 1, 0, 3, 3, 3, 0,
+	2, 2, 0, 0, 2, 2, 2, 0, 1, 3, 1, 0, 3, 3, 3, 0,
+	2, 2, 0, 0, 2, 2, 2, 0, 1, 2, 1, 0, 3, 3, 3, 0,
+	2, 2, 0, 0, 2, 2, 2, 0, 1, 3, 1, 0, 3, 3, 3, 0,
+	2, 2, 0, 0, 2, 2, 2, 0, 1, 2, 1, 0, 3, 3, 3, 0,
+	2, 2, 0, 0, 2, 2, 2, 0, 1, 3, 1, 0, 3, 3, 3, 0,
+}
+
+// Names indicates the name of each instruction
+var Names = [256]string{
+	"BRK", "ORA", "KIL", "SLO", "NOP", "ORA", "ASL", "SLO",
+	"PHP", "ORA", "ASL", "ANC", "NOP", "ORA", "ASL", "SLO",
+	"BPL", "ORA", "KIL", "SLO", "NOP", "ORA", "ASL", "SLO",
+	"CLC", "ORA", "NOP", "SLO", "NOP", "ORA", "ASL", "SLO",
+	"JSR", "AND", "KIL", "RLA", "BIT", "AND", "ROL", "RLA",
+	"PLP", "AND", "ROL", "ANC", "BIT", "AND", "ROL", "RLA",
+	"BMI", "AND", "KIL", "RLA", "NOP", "AND", "ROL", "RLA",
+	"SEC", "AND", "NOP", "RLA", "NOP", "AND", "ROL", "RLA",
+	"RTI", "EOR", "KIL", "SRE", "NOP", "EOR", "LSR", "SRE",
+	"PHA", "EOR", "LSR", "ALR", "JMP", "EOR", "LSR", "SRE",
+	"BVC", "EOR", "KIL", "SRE", "NOP", "EOR", "LSR", "SRE",
+	"CLI", "EOR", "NOP", "SRE", "NOP", "EOR", "LSR", "SRE",
+	"RTS", "ADC", "KIL", "RRA", "NOP", "ADC", "ROR", "RRA",
+	"PLA", "ADC", "ROR", "ARR", "JMP", "ADC", "ROR", "RRA",
+	"BVS", "ADC", "KIL", "RRA", "NOP", "ADC", "ROR", "RRA",
+	"SEI", "ADC", "NOP", "RRA", "NOP", "ADC", "ROR", "RRA",
+	"NOP", "STA", "NOP", "SAX", "STY", "STA", "STX", "SAX",
+	"DEY", "NOP", "TXA", "XAA", "STY", "STA", "STX", "SAX",
+	"BCC", "STA", "KIL", "AHX", "STY", "STA", "STX", "SAX",
+	"TYA", "STA", "TXS", "TAS", "SHY", "STA", "SHX", "AHX",
+	"LDY", "LDA", "LDX", "LAX", "LDY", "LDA", "LDX", "LAX",
+	"TAY", "LDA", "TAX", "LAX", "LDY", "LDA", "LDX", "LAX",
+	"BCS", "LDA", "KIL", "LAX", "LDY", "LDA", "LDX", "LAX",
+	"CLV", "LDA", "TSX", "LAS", "LDY", "LDA", "LDX", "LAX",
+	"CPY", "CMP", "NOP", "DCP", "CPY", "CMP", "DEC", "DCP",
+	"INY", "CMP", "DEX", "AXS", "CPY", "CMP", "DEC", "DCP",
+	"BNE", "CMP", "KIL", "DCP", "NOP", "CMP", "DEC", "DCP",
+	"CLD", "CMP", "NOP", "DCP", "NOP", "CMP", "DEC", "DCP",
+	"CPX", "SBC", "NOP", "ISC", "CPX", "SBC", "INC", "ISC",
+	"INX", "SBC", "NOP", "SBC", "CPX", "SBC", "INC", "ISC",
+	"BEQ", "SBC", "KIL", "ISC", "NOP", "SBC", "INC", "ISC",
+	"SED", "SBC", "NOP", "ISC", "NOP", "SBC", "INC", "ISC",
+}
+
+// modeSizes is the size of an instruction in each addressing mode. Unlike
+// Sizes it also covers the unofficial opcodes.
+var modeSizes = [...]int{
+	Absolute: 3, AbsoluteX: 3, AbsoluteY: 3, Accumulator: 1, Immediate: 2,
+	Implied: 1, IndexedIndirect: 2, Indirect: 3, IndirectIndexed: 2,
+	Relative: 2, ZeroPage: 2, ZeroPageX: 2, ZeroPageY: 2,
+}
+
+// Instruction is a decoded instruction
+type Instruction struct {
+	Address uint16 `json:"address"`
+	Bytes   []byte `json:"bytes"`
+	Name    string `json:"name"`
+	Mode    byte   `json:"mode"`
+	// Value is the operand: a byte, an address, or the branch target of a
+	// relative one
+	Value uint16 `json:"value"`
+}
+
+// Decode decode the instruction at an address, reading memory with read
+func Decode(read func(address uint16) byte, address uint16) Instruction {
+	opcode := read(address)
+	i := Instruction{Address: address, Name: Names[opcode], Mode: Modes[opcode]}
+	for j := 0; j < modeSizes[i.Mode]; j++ {
+		i.Bytes = append(i.Bytes, read(address+uint16(j)))
+	}
+	switch len(i.Bytes) {
+	case 2:
+		i.Value = uint16(i.Bytes[1])
+	case 3:
+		i.Value = uint16(i.Bytes[1]) | uint16(i.Bytes[2])<<8
+	}
+	if i.Mode == Relative {
+		i.Value = address + 2 + uint16(int8(i.Bytes[1]))
+	}
+	return i
+}
+
+// Target returns the address a branch, jump or subroutine call goes to.
+// Indirect jumps have no known target.
+func (i Instruction) Target() (uint16, bool) {
+	switch {
+	case i.Mode == Relative:
+		return i.Value, true
+	case i.Mode == Absolute && (i.Name == "JMP" || i.Name == "JSR"):
+		return i.Value, true
+	}
+	return 0, false
+}
+
+// Ends returns whether execution never goes on to the next instruction
+func (i Instruction) Ends() bool {
+	switch i.Name {
+	case "JMP", "RTS", "RTI", "BRK", "KIL":
+		return true
+	}
+	return false
+}
+
+// Operand returns the operand in assembler syntax, such as "($20),Y".
+// Addresses found in labels are replaced by their label.
+func (i Instruction) Operand(labels map[uint16]string) string {
+	address := func(format string) string {
+		if label, ok := labels[i.Value]; ok {
+			return label
+		}
+		return fmt.Sprintf(format, i.Value)
+	}
+	switch i.Mode {
+	case Absolute, Relative:
+		return address("$%04X")
+	case AbsoluteX:
+		return address("$%04X") + ",X"
+	case AbsoluteY:
+		return address("$%04X") + ",Y"
+	case Accumulator:
+		return "A"
+	case Immediate:
+		return fmt.Sprintf("#$%02X", i.Value)
+	case IndexedIndirect:
+		return "(" + address("$%02X") + ",X)"
+	case Indirect:
+		return "(" + address("$%04X") + ")"
+	case IndirectIndexed:
+		return "(" + address("$%02X") + "),Y"
+	case ZeroPage:
+		return address("$%02X")
+	case ZeroPageX:
+		return address("$%02X") + ",X"
+	case ZeroPageY:
+		return address("$%02X") + ",Y"
+	}
+	return ""
+}
+
+// Text returns the instruction in assembler syntax, such as "BNE $C120"
+func (i Instruction) Text(labels map[uint16]string) string {
+	return strings.TrimSpace(i.Name + " " + i.Operand(labels))
+}
+
+// String returns the instruction as a disassembly line with its address
+// and bytes, such as "C123  D0 FB     BNE $C120"
+func (i Instruction) String() string {
+	bytes := make([]string, len(i.Bytes))
+	for j, b := range i.Bytes {
+		bytes[j] = fmt.Sprintf("%02X", b)
+	}
+	return fmt.Sprintf("%04X  %-8s  %s", i.Address, strings.Join(bytes, " "), i.Text(nil))
+}
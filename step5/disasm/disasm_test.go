@@ -0,0 +1,106 @@
+package disasm
+
+import "testing"
+
+// decodeBytes decode an instruction from bytes placed at address
+func decodeBytes(address uint16, bytes ...byte) Instruction {
+	return Decode(func(a uint16) byte {
+		if int(a-address) < len(bytes) {
+			return bytes[a-address]
+		}
+		return 0
+	}, address)
+}
+
+func TestDecodeModes(t *testing.T) {
+	tests := []struct {
+		address uint16
+		bytes   []byte
+		mode    byte
+		text    string
+	}{
+		{0xC000, []byte{0xAD, 0x34, 0x12}, Absolute, "LDA $1234"},
+		{0xC000, []byte{0xBD, 0x34, 0x12}, AbsoluteX, "LDA $1234,X"},
+		{0xC000, []byte{0xB9, 0x34, 0x12}, AbsoluteY, "LDA $1234,Y"},
+		{0xC000, []byte{0x0A}, Accumulator, "ASL A"},
+		{0xC000, []byte{0xA9, 0x05}, Immediate, "LDA #$05"},
+		{0xC000, []byte{0xEA}, Implied, "NOP"},
+		{0xC000, []byte{0xA1, 0x20}, IndexedIndirect, "LDA ($20,X)"},
+		{0xC000, []byte{0x6C, 0x34, 0x12}, Indirect, "JMP ($1234)"},
+		{0xC000, []byte{0xB1, 0x20}, IndirectIndexed, "LDA ($20),Y"},
+		{0xC123, []byte{0xD0, 0xFB}, Relative, "BNE $C120"},
+		{0xC000, []byte{0x10, 0x10}, Relative, "BPL $C012"},
+		{0xC000, []byte{0xA5, 0x20}, ZeroPage, "LDA $20"},
+		{0xC000, []byte{0xB5, 0x20}, ZeroPageX, "LDA $20,X"},
+		{0xC000, []byte{0xB6, 0x20}, ZeroPageY, "LDX $20,Y"},
+	}
+	for _, test := range tests {
+		i := decodeBytes(test.address, test.bytes...)
+		if i.Mode != test.mode {
+			t.Errorf("% X: mode %d, want %d", test.bytes, i.Mode, test.mode)
+		}
+		if len(i.Bytes) != len(test.bytes) {
+			t.Errorf("% X: %d bytes, want %d", test.bytes, len(i.Bytes), len(test.bytes))
+		}
+		if got := i.Text(nil); got != test.text {
+			t.Errorf("% X: %q, want %q", test.bytes, got, test.text)
+		}
+	}
+}
+
+func TestOperandLabels(t *testing.T) {
+	labels := map[uint16]string{0xC120: "loop", 0x1234: "table", 0x0020: "ptr"}
+	tests := []struct {
+		address uint16
+		bytes   []byte
+		text    string
+	}{
+		{0xC123, []byte{0xD0, 0xFB}, "BNE loop"},
+		{0xC000, []byte{0x20, 0x20, 0xC1}, "JSR loop"},
+		{0xC000, []byte{0xBD, 0x34, 0x12}, "LDA table,X"},
+		{0xC000, []byte{0x6C, 0x34, 0x12}, "JMP (table)"},
+		{0xC000, []byte{0xB1, 0x20}, "LDA (ptr),Y"},
+		{0xC000, []byte{0xA9, 0x20}, "LDA #$20"},
+		{0xC000, []byte{0xAD, 0x35, 0x12}, "LDA $1235"},
+	}
+	for _, test := range tests {
+		if got := decodeBytes(test.address, test.bytes...).Text(labels); got != test.text {
+			t.Errorf("% X: %q, want %q", test.bytes, got, test.text)
+		}
+	}
+}
+
+func TestTargetAndEnds(t *testing.T) {
+	tests := []struct {
+		bytes  []byte
+		target uint16
+		ok     bool
+		ends   bool
+	}{
+		{[]byte{0xD0, 0x02}, 0xC004, true, false},
+		{[]byte{0x20, 0x00, 0xD0}, 0xD000, true, false},
+		{[]byte{0x4C, 0x00, 0xD0}, 0xD000, true, true},
+		{[]byte{0x6C, 0x00, 0xD0}, 0, false, true},
+		{[]byte{0xAD, 0x00, 0xD0}, 0, false, false},
+		{[]byte{0x60}, 0, false, true},
+		{[]byte{0x40}, 0, false, true},
+		{[]byte{0x00}, 0, false, true},
+	}
+	for _, test := range tests {
+		i := decodeBytes(0xC000, test.bytes...)
+		target, ok := i.Target()
+		if target != test.target || ok != test.ok {
+			t.Errorf("% X: target $%04X %v, want $%04X %v", test.bytes, target, ok, test.target, test.ok)
+		}
+		if i.Ends() != test.ends {
+			t.Errorf("% X: ends %v, want %v", test.bytes, i.Ends(), test.ends)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	i := decodeBytes(0xC123, 0xD0, 0xFB)
+	if got, want := i.String(), "C123  D0 FB     BNE $C120"; got != want {
+		t.Errorf("%q, want %q", got, want)
+	}
+}
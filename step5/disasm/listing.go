@@ -0,0 +1,275 @@
+package disasm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Vector addresses of the 6502
+const (
+	VectorNMI   = 0xFFFA
+	VectorReset = 0xFFFC
+	VectorIRQ   = 0xFFFE
+)
+
+// dataPerLine is the most bytes on a .byte line, minRun the shortest run of
+// a repeated byte written as .res
+const (
+	dataPerLine = 8
+	minRun      = 16
+)
+
+// Listing disassembles a block of memory, such as a PRG bank, mapped at an
+// origin address. Bytes become code when they are reached by following
+// the code from entry points, or all of them with Linear; the others are
+// listed as data.
+type Listing struct {
+	Org  uint16
+	Data []byte
+	// Labels name addresses, the targets of branches, jumps and
+	// subroutine calls get one when not named already
+	Labels       map[uint16]string
+	instructions map[uint16]Instruction
+	code         []bool // bytes belonging to an instruction
+}
+
+// NewListing prepare the listing of data mapped at org
+func NewListing(data []byte, org uint16) *Listing {
+	return &Listing{
+		Org:          org,
+		Data:         data,
+		Labels:       map[uint16]string{},
+		instructions: map[uint16]Instruction{},
+		code:         make([]bool, len(data)),
+	}
+}
+
+// contains returns whether an address falls within the listing
+func (l *Listing) contains(address uint16) bool {
+	return address >= l.Org && int(address-l.Org) < len(l.Data)
+}
+
+func (l *Listing) read(address uint16) byte {
+	if !l.contains(address) {
+		return 0
+	}
+	return l.Data[address-l.Org]
+}
+
+// Vector returns the address stored in a vector, if the listing holds it
+func (l *Listing) Vector(vector uint16) (uint16, bool) {
+	if !l.contains(vector) || !l.contains(vector+1) {
+		return 0, false
+	}
+	return uint16(l.read(vector)) | uint16(l.read(vector+1))<<8, true
+}
+
+// decode an instruction that fits in the listing and does not overlap code
+// found already
+func (l *Listing) decode(address uint16) (Instruction, bool) {
+	i := Decode(l.read, address)
+	for j := range i.Bytes {
+		a := address + uint16(j)
+		if !l.contains(a) || l.code[a-l.Org] {
+			return i, false
+		}
+	}
+	return i, true
+}
+
+// add record a decoded instruction
+func (l *Listing) add(i Instruction) {
+	l.instructions[i.Address] = i
+	for j := range i.Bytes {
+		l.code[i.Address+uint16(j)-l.Org] = true
+	}
+}
+
+// label name the target of an instruction, sub_XXXX for subroutines and
+// L_XXXX for the others
+func (l *Listing) label(i Instruction) {
+	target, ok := i.Target()
+	if !ok || !l.contains(target) {
+		return
+	}
+	if _, ok := l.Labels[target]; ok {
+		return
+	}
+	if i.Name == "JSR" {
+		l.Labels[target] = fmt.Sprintf("sub_%04X", target)
+	} else {
+		l.Labels[target] = fmt.Sprintf("L_%04X", target)
+	}
+}
+
+// Follow decode the code reachable from entry points, through branches,
+// jumps and subroutine calls. Indirect jumps cannot be followed; their
+// targets can be given as more entry points.
+func (l *Listing) Follow(entries ...uint16) {
+	queue := append([]uint16(nil), entries...)
+	for len(queue) > 0 {
+		pc := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		for l.contains(pc) {
+			if _, ok := l.instructions[pc]; ok {
+				break
+			}
+			i, ok := l.decode(pc)
+			if !ok {
+				break
+			}
+			l.add(i)
+			l.label(i)
+			if target, ok := i.Target(); ok && l.contains(target) {
+				queue = append(queue, target)
+			}
+			if i.Ends() {
+				break
+			}
+			pc += uint16(len(i.Bytes))
+		}
+	}
+}
+
+// Linear decode every byte as code, one instruction after the other.
+// Targets get labels when they fall on the start of an instruction.
+func (l *Listing) Linear() {
+	for pc := l.Org; l.contains(pc); {
+		i, ok := l.decode(pc)
+		if !ok {
+			break
+		}
+		l.add(i)
+		pc += uint16(len(i.Bytes))
+	}
+	for _, i := range l.instructions {
+		if target, ok := i.Target(); ok {
+			if _, ok := l.instructions[target]; ok {
+				l.label(i)
+			}
+		}
+	}
+}
+
+// printable returns the labels that can be defined in the listing, those of
+// addresses starting an instruction or a line of data. Labels of addresses
+// within an instruction are left out, so the operands referring to them are
+// written as plain numbers.
+func (l *Listing) printable() map[uint16]string {
+	labels := map[uint16]string{}
+	for address, label := range l.Labels {
+		if l.contains(address) && l.code[address-l.Org] {
+			if _, ok := l.instructions[address]; !ok {
+				continue
+			}
+		}
+		labels[address] = label
+	}
+	return labels
+}
+
+// WriteTo write the listing in assembler syntax: labels, instructions with
+// their address and bytes, and data as .byte lines, or .res for long runs
+// of a repeated byte
+func (l *Listing) WriteTo(w io.Writer) (int64, error) {
+	out := &countWriter{w: bufio.NewWriter(w)}
+	labels := l.printable()
+	for offset := 0; offset < len(l.Data); {
+		address := l.Org + uint16(offset)
+		if label, ok := labels[address]; ok {
+			fmt.Fprintf(out, "%s:\n", label)
+		}
+		if i, ok := l.instructions[address]; ok {
+			bytes := make([]string, len(i.Bytes))
+			for j, b := range i.Bytes {
+				bytes[j] = fmt.Sprintf("%02X", b)
+			}
+			fmt.Fprintf(out, "  %04X  %-8s  %s\n", address, strings.Join(bytes, " "), i.Text(labels))
+			offset += len(i.Bytes)
+			continue
+		}
+		// data up to the next code or label
+		end := offset + 1
+		for end < len(l.Data) && !l.code[end] {
+			if _, ok := labels[l.Org+uint16(end)]; ok {
+				break
+			}
+			end++
+		}
+		run := offset + 1
+		for run < end && l.Data[run] == l.Data[offset] {
+			run++
+		}
+		if run-offset >= minRun {
+			fmt.Fprintf(out, "  %04X            .res %d, $%02X\n", address, run-offset, l.Data[offset])
+			offset = run
+			continue
+		}
+		if end-offset > dataPerLine {
+			end = offset + dataPerLine
+		}
+		// leave a long run for the next line
+		for j := offset + 1; j < end; j++ {
+			n := j
+			for n < len(l.Data) && n-j < minRun && !l.code[n] && l.Data[n] == l.Data[j] {
+				n++
+			}
+			if n-j == minRun {
+				end = j
+				break
+			}
+		}
+		values := make([]string, end-offset)
+		for j := range values {
+			values[j] = fmt.Sprintf("$%02X", l.Data[offset+j])
+		}
+		fmt.Fprintf(out, "  %04X            .byte %s\n", address, strings.Join(values, ","))
+		offset = end
+	}
+	err := out.w.(*bufio.Writer).Flush()
+	if out.err != nil {
+		err = out.err
+	}
+	return out.n, err
+}
+
+// Entries returns the targets of the vectors the listing holds, in address
+// order, and labels them nmi, reset and irq
+func (l *Listing) Entries() []uint16 {
+	var entries []uint16
+	for _, v := range []struct {
+		vector uint16
+		name   string
+	}{{VectorNMI, "nmi"}, {VectorReset, "reset"}, {VectorIRQ, "irq"}} {
+		target, ok := l.Vector(v.vector)
+		if !ok || !l.contains(target) {
+			continue
+		}
+		if _, ok := l.Labels[target]; !ok {
+			l.Labels[target] = v.name
+			entries = append(entries, target)
+		}
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a] < entries[b] })
+	return entries
+}
+
+// countWriter counts the bytes written and keeps the first error
+type countWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	c.err = err
+	return n, err
+}
@@ -0,0 +1,105 @@
+package disasm
+
+import (
+	"strings"
+	"testing"
+)
+
+func listing(t *testing.T, l *Listing) string {
+	var out strings.Builder
+	if _, err := l.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestListingFollow(t *testing.T) {
+	data := make([]byte, 0x20)
+	copy(data, []byte{
+		0x20, 0x08, 0xC0, // C000 JSR sub_C008
+		0xD0, 0xFB, // C003 BNE reset
+		0x4C, 0x03, 0xC0, // C005 JMP L_C003
+		0x60, // C008 RTS
+	})
+	l := NewListing(data, 0xC000)
+	entries := l.Entries()
+	if len(entries) != 0 {
+		t.Fatalf("entries %v, the vectors are outside the listing", entries)
+	}
+	l.Labels[0xC000] = "reset"
+	l.Follow(0xC000)
+	want := `reset:
+  C000  20 08 C0  JSR sub_C008
+L_C003:
+  C003  D0 FB     BNE reset
+  C005  4C 03 C0  JMP L_C003
+sub_C008:
+  C008  60        RTS
+  C009            .res 23, $00
+`
+	if got := listing(t, l); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestListingTargetInsideInstruction(t *testing.T) {
+	l := NewListing([]byte{
+		0xA9, 0xD0, // C000 LDA #$D0
+		0xD0, 0xFD, // C002 BNE $C001, inside the LDA
+		0x4C, 0x03, 0xC0, // C004 JMP $C003, inside the BNE
+	}, 0xC000)
+	l.Follow(0xC000)
+	want := `  C000  A9 D0     LDA #$D0
+  C002  D0 FD     BNE $C001
+  C004  4C 03 C0  JMP $C003
+`
+	if got := listing(t, l); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestListingEntriesAndData(t *testing.T) {
+	data := make([]byte, 0x40)
+	data[0] = 0x40 // $FFC0 RTI
+	data[1] = 0x60 // $FFC1 RTS
+	data[2] = 0x4C // $FFC2 JMP $FFC2
+	data[3] = 0xC2
+	data[4] = 0xFF
+	for i := 0x10; i < 0x3A; i++ {
+		data[i] = 0xFF
+	}
+	copy(data[0x3A:], []byte{0xC0, 0xFF, 0xC2, 0xFF, 0xC1, 0xFF})
+	l := NewListing(data, 0xFFC0)
+	entries := l.Entries()
+	if len(entries) != 3 || entries[0] != 0xFFC0 || entries[1] != 0xFFC1 || entries[2] != 0xFFC2 {
+		t.Fatalf("entries %X", entries)
+	}
+	l.Follow(entries...)
+	want := `nmi:
+  FFC0  40        RTI
+irq:
+  FFC1  60        RTS
+reset:
+  FFC2  4C C2 FF  JMP reset
+  FFC5            .byte $00,$00,$00,$00,$00,$00,$00,$00
+  FFCD            .byte $00,$00,$00
+  FFD0            .res 42, $FF
+  FFFA            .byte $C0,$FF,$C2,$FF,$C1,$FF
+`
+	if got := listing(t, l); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestListingLinear(t *testing.T) {
+	l := NewListing([]byte{0xCA, 0xD0, 0xFD, 0x60}, 0x8000)
+	l.Linear()
+	want := `L_8000:
+  8000  CA        DEX
+  8001  D0 FD     BNE L_8000
+  8003  60        RTS
+`
+	if got := listing(t, l); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/shadow1163/nes-go/step5/nes"
+)
+
+// frameHub hands the latest frame to every renderer. Renderers that fall
+// behind skip frames instead of slowing down the emulation.
+type frameHub struct {
+	sync.Mutex
+	latest      *image.RGBA
+	latestFrame int
+	subscribers map[chan *image.RGBA]bool
+}
+
+// subscribe returns a channel receiving every new frame
+func (h *frameHub) subscribe() chan *image.RGBA {
+	h.Lock()
+	defer h.Unlock()
+	if h.subscribers == nil {
+		h.subscribers = map[chan *image.RGBA]bool{}
+	}
+	ch := make(chan *image.RGBA, 1)
+	if h.latest != nil {
+		ch <- h.latest
+	}
+	h.subscribers[ch] = true
+	return ch
+}
+
+func (h *frameHub) unsubscribe(ch chan *image.RGBA) {
+	h.Lock()
+	defer h.Unlock()
+	delete(h.subscribers, ch)
+}
+
+// publish replace the latest frame, n is its frame number. Frames are
+// never modified once published.
+func (h *frameHub) publish(frame *image.RGBA, n int) {
+	h.Lock()
+	defer h.Unlock()
+	h.latest = frame
+	h.latestFrame = n
+	for ch := range h.subscribers {
+		// drop a frame the subscriber has not picked up yet
+		select {
+		case <-ch:
+		default:
+		}
+		ch <- frame
+	}
+}
+
+// last returns the latest frame and its number, nil before the first one
+func (h *frameHub) last() (*image.RGBA, int) {
+	h.Lock()
+	defer h.Unlock()
+	return h.latest, h.latestFrame
+}
+
+// emulator runs the console in its own goroutine, paced to the console
+// frame rate, and publishes every frame to the renderers. HTTP handlers
+// must hold the lock while touching the console.
+type emulator struct {
+	sync.Mutex
+	console     *nes.Console
+	frameRate   float64
+	paused      bool
+	advance     int // frames to run while paused
+	speed       float64
+	turbo       bool // run as fast as the host can
+	fastForward bool
+	recorder    recorder
+	// rewind holds the recent states, nil when rewinding is disabled
+	rewind    *rewindBuffer
+	rewinding bool
+	// stateSlot is the save state slot used by the hotkeys
+	stateSlot int
+
+	frames frameHub
+}
+
+// newEmulator wrap a console, frameRate 0 uses the cartridge region's
+func newEmulator(console *nes.Console, frameRate float64) *emulator {
+	if frameRate == 0 {
+		frameRate = console.FrameRate()
+	}
+	return &emulator{console: console, frameRate: frameRate, speed: 1}
+}
+
+// do run f with exclusive access to the console
+func (e *emulator) do(f func(console *nes.Console)) {
+	e.Lock()
+	defer e.Unlock()
+	f(e.console)
+}
+
+// run emulate forever, one frame per frame period scaled by the speed.
+// When the host falls more than a few frames behind the schedule is reset
+// instead of running a burst of frames to catch up. Above normal speed
+// frames are published at most at the console frame rate, as nobody can
+// watch more.
+func (e *emulator) run() {
+	next := time.Now()
+	var published time.Time
+	for {
+		e.Lock()
+		switch {
+		case e.rewinding:
+			if err := e.rewindStep(); err != nil {
+				log.Error(err)
+				e.rewinding = false
+			}
+		case e.paused:
+			if e.advance > 0 {
+				e.stepFrame()
+				e.advance--
+			}
+		default:
+			n := 1
+			if e.fastForward {
+				n = fastForwardFrames
+			}
+			for i := 0; i < n; i++ {
+				e.stepFrame()
+			}
+		}
+		display := time.Duration(float64(time.Second) / e.frameRate)
+		period := time.Duration(float64(display) / e.speed)
+		uncapped := e.turbo && !e.paused && !e.rewinding
+		var frame *image.RGBA
+		n := e.console.Frame
+		if time.Since(published) >= display*9/10 {
+			frame = image.NewRGBA(image.Rect(0, 0, 256, 240))
+			copy(frame.Pix, e.console.Buffer().Pix)
+		}
+		e.Unlock()
+		if frame != nil {
+			e.frames.publish(frame, n)
+			published = time.Now()
+		}
+
+		if uncapped {
+			next = time.Now()
+			continue
+		}
+		next = next.Add(period)
+		if wait := time.Until(next); wait > 0 {
+			time.Sleep(wait)
+		} else if wait < -4*period {
+			next = time.Now()
+		}
+	}
+}
+
+// speeds are the steps of the speed hotkeys
+var speeds = []float64{0.25, 0.5, 0.75, 1, 1.5, 2, 3, 4, 6, 8}
+
+// setSpeed change the emulation speed, 0.25 to 8 times the normal one.
+// The lock must be held.
+func (e *emulator) setSpeed(speed float64) error {
+	if speed < speeds[0] || speed > speeds[len(speeds)-1] {
+		return fmt.Errorf("speed %g is out of range %g-%g", speed, speeds[0], speeds[len(speeds)-1])
+	}
+	e.speed = speed
+	log.Info(fmt.Sprintf("speed %g%%", speed*100))
+	return nil
+}
+
+// stepSpeed go to the next speed step up or down, the lock must be held
+func (e *emulator) stepSpeed(up bool) {
+	i := sort.SearchFloat64s(speeds, e.speed)
+	switch {
+	case up && i < len(speeds) && speeds[i] == e.speed:
+		i++
+	case !up:
+		i--
+	}
+	if i >= 0 && i < len(speeds) {
+		e.setSpeed(speeds[i])
+	}
+}
+
+// frameAdvance pause, or run a single frame when already paused. The lock
+// must be held.
+func (e *emulator) frameAdvance() {
+	if e.paused {
+		e.advance++
+	} else {
+		e.paused = true
+	}
+}
+
+// stepFrame run one frame with the current input, the lock must be held
+func (e *emulator) stepFrame() {
+	keys.nextFrame(e.console)
+	frame := e.console.Frame
+	e.console.StepFrame()
+	if e.console.Frame == frame {
+		// stopped by the debugger, the frame finishes once it resumes
+		return
+	}
+	if e.console.Frame%sramFlushFrames == 0 {
+		flushSRAM()
+	}
+	if e.rewind != nil && e.console.Frame%e.rewind.interval == 0 {
+		var state bytes.Buffer
+		e.console.SaveState(&state)
+		e.rewind.push(state.Bytes())
+	}
+	if e.recorder != nil {
+		if err := e.recorder.frame(e.console.Buffer(), e.console.Samples()); err != nil {
+			log.Error(err)
+			e.stopRecording()
+		}
+	}
+}
+
+// rewindStep go back to the newest state in the rewind buffer and drop
+// it, the lock must be held
+func (e *emulator) rewindStep() error {
+	state := e.rewind.pop()
+	if state == nil {
+		return nil
+	}
+	return e.console.LoadState(bytes.NewReader(state))
+}
+
+// startRecording record every frame to a file from now on, the lock must
+// be held
+func (e *emulator) startRecording(filename string) error {
+	if e.recorder != nil {
+		return errors.New("already recording")
+	}
+	r, err := newRecorder(filename, "", e.console)
+	if err != nil {
+		return err
+	}
+	e.recorder = r
+	log.Info("recording to " + filename)
+	return nil
+}
+
+// stopRecording finish the recording, if any, the lock must be held
+func (e *emulator) stopRecording() error {
+	if e.recorder == nil {
+		return nil
+	}
+	err := e.recorder.close()
+	e.recorder = nil
+	log.Info("recording stopped")
+	return err
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/shadow1163/nes-go/step5/nes"
+)
+
+// buttonNames are the joypad buttons as written in input scripts
+var buttonNames = map[string]int{
+	"a":      nes.ButtonA,
+	"b":      nes.ButtonB,
+	"select": nes.ButtonSelect,
+	"start":  nes.ButtonStart,
+	"up":     nes.ButtonUp,
+	"down":   nes.ButtonDown,
+	"left":   nes.ButtonLeft,
+	"right":  nes.ButtonRight,
+}
+
+// inputEvent sets the buttons held by a player from a frame on
+type inputEvent struct {
+	frame   int
+	player  int
+	buttons [8]bool
+}
+
+// readInputScript parse an input script. Each line is
+//
+//	FRAME PLAYER BUTTONS
+//
+// where PLAYER is 1 or 2 and BUTTONS a comma separated list such as
+// "Start" or "Right,A", or "-" for none. The buttons stay held until the
+// next line for the same player. Blank lines and lines starting with # are
+// ignored. Lines must be in frame order.
+func readInputScript(filename string) ([]inputEvent, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var events []inputEvent
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: want FRAME PLAYER BUTTONS", filename, line)
+		}
+		var event inputEvent
+		event.frame, err = strconv.Atoi(fields[0])
+		if err != nil || event.frame < 0 {
+			return nil, fmt.Errorf("%s:%d: bad frame %q", filename, line, fields[0])
+		}
+		if len(events) > 0 && event.frame < events[len(events)-1].frame {
+			return nil, fmt.Errorf("%s:%d: frame %d is out of order", filename, line, event.frame)
+		}
+		switch fields[1] {
+		case "1":
+			event.player = 0
+		case "2":
+			event.player = 1
+		default:
+			return nil, fmt.Errorf("%s:%d: bad player %q", filename, line, fields[1])
+		}
+		if fields[2] != "-" {
+			for _, name := range strings.Split(fields[2], ",") {
+				button, ok := buttonNames[strings.ToLower(name)]
+				if !ok {
+					return nil, fmt.Errorf("%s:%d: unknown button %q", filename, line, name)
+				}
+				event.buttons[button] = true
+			}
+		}
+		events = append(events, event)
+	}
+	return events, scanner.Err()
+}
+
+// ramCondition compares a byte of memory with a value
+type ramCondition struct {
+	address uint16
+	op      string
+	value   byte
+}
+
+// conditionOps are the comparisons a ramCondition accepts, two character
+// ones first so "<=" is not read as "<"
+var conditionOps = []string{"==", "!=", "<=", ">=", "<", ">"}
+
+// parseNumber parse a decimal, 0x or $ prefixed hex number
+func parseNumber(s string, bits int) (uint64, error) {
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "$") {
+		return strconv.ParseUint(s[1:], 16, bits)
+	}
+	return strconv.ParseUint(s, 0, bits)
+}
+
+// parseCondition parse a condition such as "$6000==0x80" or "0x00F0 != 0"
+func parseCondition(s string) (*ramCondition, error) {
+	for _, op := range conditionOps {
+		i := strings.Index(s, op)
+		if i < 0 {
+			continue
+		}
+		address, err := parseNumber(s[:i], 16)
+		if err != nil {
+			return nil, fmt.Errorf("bad address in condition %q", s)
+		}
+		value, err := parseNumber(s[i+len(op):], 8)
+		if err != nil {
+			return nil, fmt.Errorf("bad value in condition %q", s)
+		}
+		return &ramCondition{uint16(address), op, byte(value)}, nil
+	}
+	return nil, fmt.Errorf("condition %q has no comparison, want e.g. $6000==0x80", s)
+}
+
+func (c *ramCondition) met(console *nes.Console) bool {
+	value := console.Peek(c.address)
+	switch c.op {
+	case "==":
+		return value == c.value
+	case "!=":
+		return value != c.value
+	case "<=":
+		return value <= c.value
+	case ">=":
+		return value >= c.value
+	case "<":
+		return value < c.value
+	case ">":
+		return value > c.value
+	}
+	return false
+}
+
+// parseFrames parse a comma separated list of frame numbers
+func parseFrames(s string) (map[int]bool, error) {
+	frames := map[int]bool{}
+	if s == "" {
+		return frames, nil
+	}
+	for _, field := range strings.Split(s, ",") {
+		frame, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || frame < 1 {
+			return nil, fmt.Errorf("bad frame %q", field)
+		}
+		frames[frame] = true
+	}
+	return frames, nil
+}
+
+// dumpRAM write the 2KB of CPU RAM to a file, or as a hex dump to stdout
+// for "-"
+func dumpRAM(filename string, console *nes.Console) error {
+	if filename == "-" {
+		dumper := hex.Dumper(os.Stdout)
+		dumper.Write(console.CPU.RAM[:])
+		return dumper.Close()
+	}
+	return os.WriteFile(filename, console.CPU.RAM[:], 0644)
+}
+
+// runHeadless implement "nes run": emulate as fast as possible without a
+// display, for automated tests. It returns the exit status: 0 on success
+// or once the -exit-on condition is met, 1 on errors and 2 when the
+// condition was never met.
+func runHeadless(args []string) int {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	rom := addROMFlags(flags)
+	frames := flags.Int("frames", 600, "number of frames to run")
+	script := flags.String("input", "", "input script, lines of FRAME PLAYER BUTTONS")
+	screenshotAt := flags.String("screenshot-at", "", "comma separated frames to save a screenshot after")
+	shotDir := flags.String("screenshot-dir", ".", "directory to save screenshots in")
+	scale := flags.Int("scale", 1, "screenshot scale factor")
+	crop := flags.Bool("crop", false, "crop the screenshot overscan")
+	ramFile := flags.String("dump-ram", "", "file to write the CPU RAM to at exit, - for a hex dump")
+	exitOn := flags.String("exit-on", "", "stop once a memory condition holds, e.g. $6000==0x80")
+	recordFile := flags.String("record", "", "record the run to a .gif, .apng or .y4m file, - for Y4M on stdout")
+	wavFile := flags.String("record-wav", "", "WAV file for the audio of a Y4M recording")
+	movieFile := flags.String("movie", "", "play a .fm2 or .nesm input movie, which overrides -input")
+	cheatCodes := flags.String("cheats", "", "comma separated Game Genie or ADDRESS:VALUE cheat codes")
+	recordMovie := flags.String("record-movie", "", "record the input to a .fm2 or .nesm movie")
+	debug := flags.Bool("debug", false, "stop before the first instruction and prompt for debugger commands")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: nes run [flags] FILENAME.ROM")
+		flags.PrintDefaults()
+	}
+	names, err := parseFlags(flags, args)
+	if err != nil || len(names) != 1 {
+		flags.Usage()
+		return 1
+	}
+	romFile := names[0]
+
+	var events []inputEvent
+	if *script != "" {
+		if events, err = readInputScript(*script); err != nil {
+			log.Error(err)
+			return 1
+		}
+	}
+	shots, err := parseFrames(*screenshotAt)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+	var condition *ramCondition
+	if *exitOn != "" {
+		if condition, err = parseCondition(*exitOn); err != nil {
+			log.Error(err)
+			return 1
+		}
+	}
+	cart, err := rom.load(romFile, false)
+	if err != nil {
+		log.Error(err)
+		return 1
+	}
+
+	if *movieFile != "" && *recordMovie != "" {
+		log.Error("-movie and -record-movie cannot be used together")
+		return 1
+	}
+	console := nes.NewConsole(cart)
+	if *cheatCodes != "" {
+		var list []*nes.Cheat
+		for _, code := range strings.Split(*cheatCodes, ",") {
+			cheat, err := nes.ParseCheat(code)
+			if err != nil {
+				log.Error(err)
+				return 1
+			}
+			list = append(list, cheat)
+		}
+		console.SetCheats(list)
+	}
+	if *movieFile != "" {
+		movie, err := nes.LoadMovie(*movieFile)
+		if err == nil {
+			err = console.PlayMovie(movie)
+		}
+		if err != nil {
+			log.Error(err)
+			return 1
+		}
+		// run the whole movie unless told otherwise
+		framesSet := false
+		flags.Visit(func(f *flag.Flag) {
+			framesSet = framesSet || f.Name == "frames"
+		})
+		if !framesSet {
+			*frames = console.Frame + len(movie.Frames)
+		}
+	}
+	var recording *nes.Movie
+	if *recordMovie != "" {
+		recording = console.RecordMovie(romFile, false)
+	}
+	var rec recorder
+	if *recordFile != "" {
+		if rec, err = newRecorder(*recordFile, *wavFile, console); err != nil {
+			log.Error(err)
+			return 1
+		}
+	}
+	var repl *debugREPL
+	if *debug {
+		repl = &debugREPL{console: console, in: bufio.NewScanner(os.Stdin), out: os.Stdout}
+		console.Debugger().TraceOutput = os.Stdout
+		console.Debugger().Break()
+	}
+	var buttons [2][8]bool
+	status := 0
+	if condition != nil {
+		status = 2
+	}
+	for console.Frame < *frames {
+		for len(events) > 0 && events[0].frame <= console.Frame {
+			buttons[events[0].player] = events[0].buttons
+			events = events[1:]
+		}
+		console.CPU.Joypads[0].SetButtons(buttons[0])
+		console.CPU.Joypads[1].SetButtons(buttons[1])
+		frame := console.Frame
+		console.StepFrame()
+		if console.Frame == frame {
+			// the debugger stopped half way through the frame
+			if !repl.prompt() {
+				break
+			}
+			continue
+		}
+		if rec != nil {
+			if err := rec.frame(console.Buffer(), console.Samples()); err != nil {
+				log.Error(err)
+				return 1
+			}
+		}
+
+		if shots[console.Frame] {
+			filename := filepath.Join(*shotDir, screenshotName(romFile, console.Frame))
+			img := screenshotImage(console.Buffer(), *scale, *crop)
+			if err := writePNG(filename, img); err != nil {
+				log.Error(err)
+				return 1
+			}
+		}
+		if condition != nil && condition.met(console) {
+			fmt.Fprintf(os.Stderr, "%s met at frame %d\n", *exitOn, console.Frame)
+			status = 0
+			break
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%d frames, %d lag frames\n", console.Frame, console.LagFrames)
+	if recording != nil {
+		if err := recording.SaveMovie(*recordMovie); err != nil {
+			log.Error(err)
+			return 1
+		}
+	}
+	if rec != nil {
+		if err := rec.close(); err != nil {
+			log.Error(err)
+			return 1
+		}
+	}
+	if status == 2 {
+		fmt.Fprintf(os.Stderr, "%s not met after %d frames\n", *exitOn, console.Frame)
+	}
+	if *ramFile != "" {
+		if err := dumpRAM(*ramFile, console); err != nil {
+			log.Error(err)
+			return 1
+		}
+	}
+	return status
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/shadow1163/nes-go/step5/nes"
+)
+
+// turbo button indexes in controller.turbo
+const (
+	turboA = iota
+	turboB
+)
+
+// binding is what a key does on a controller
+type binding struct {
+	player int
+	button int
+	turbo  bool // button is turboA or turboB
+}
+
+// controller holds the buttons held down on one joypad
+type controller struct {
+	held  [8]bool
+	turbo [2]bool
+	// buttons held on the gamepad, merged with the keyboard ones
+	pad      [8]bool
+	padTurbo [2]bool
+	// most recently pressed direction on each D-pad axis
+	lastVertical   int
+	lastHorizontal int
+}
+
+// press or release a button
+func (c *controller) set(button int, pressed bool) {
+	c.held[button] = pressed
+	if !pressed {
+		return
+	}
+	switch button {
+	case nes.ButtonUp, nes.ButtonDown:
+		c.lastVertical = button
+	case nes.ButtonLeft, nes.ButtonRight:
+		c.lastHorizontal = button
+	}
+}
+
+// buttons returns the button state to send to the console. Turbo buttons
+// alternate every turboRate frames. With filterOpposing, holding both
+// directions of an axis, which a real D-pad cannot do, keeps only the most
+// recently pressed one.
+func (c *controller) buttons(filterOpposing bool, frame int, turboRate int) [8]bool {
+	var buttons [8]bool
+	for i := range buttons {
+		buttons[i] = c.held[i] || c.pad[i]
+	}
+	turboOn := (frame/turboRate)%2 == 0
+	if (c.turbo[turboA] || c.padTurbo[turboA]) && turboOn {
+		buttons[nes.ButtonA] = true
+	}
+	if (c.turbo[turboB] || c.padTurbo[turboB]) && turboOn {
+		buttons[nes.ButtonB] = true
+	}
+	if !filterOpposing {
+		return buttons
+	}
+	if buttons[nes.ButtonUp] && buttons[nes.ButtonDown] {
+		buttons[nes.ButtonUp] = c.lastVertical == nes.ButtonUp
+		buttons[nes.ButtonDown] = c.lastVertical == nes.ButtonDown
+	}
+	if buttons[nes.ButtonLeft] && buttons[nes.ButtonRight] {
+		buttons[nes.ButtonLeft] = c.lastHorizontal == nes.ButtonLeft
+		buttons[nes.ButtonRight] = c.lastHorizontal == nes.ButtonRight
+	}
+	return buttons
+}
+
+// input holds the state of both controllers between key events. Key
+// events only change this state; the emulation goroutine copies it to the
+// joypads before each frame.
+type input struct {
+	sync.Mutex
+	controllers    [2]controller
+	filterOpposing bool
+	turboRate      int
+	keys           map[int]binding
+	hotkeys        map[int]string
+}
+
+// keyBinding is a key of the config and what it does: a controller button,
+// or a hotkey action
+type keyBinding struct {
+	name   string // e.g. "player 1 a" or "hotkey pause"
+	code   int
+	button binding
+	action string // the hotkey action, "" for a button
+}
+
+// keyBindings list every key of a config, unbound ones included
+func (conf *config) keyBindings() []keyBinding {
+	var list []keyBinding
+	for player, p := range conf.Players {
+		for _, k := range []struct {
+			name   string
+			code   int
+			button int
+			turbo  bool
+		}{
+			{"a", p.A, nes.ButtonA, false},
+			{"b", p.B, nes.ButtonB, false},
+			{"select", p.Select, nes.ButtonSelect, false},
+			{"start", p.Start, nes.ButtonStart, false},
+			{"up", p.Up, nes.ButtonUp, false},
+			{"down", p.Down, nes.ButtonDown, false},
+			{"left", p.Left, nes.ButtonLeft, false},
+			{"right", p.Right, nes.ButtonRight, false},
+			{"turbo_a", p.TurboA, turboA, true},
+			{"turbo_b", p.TurboB, turboB, true},
+		} {
+			list = append(list, keyBinding{
+				name:   fmt.Sprintf("player %d %s", player+1, k.name),
+				code:   k.code,
+				button: binding{player, k.button, k.turbo},
+			})
+		}
+	}
+	h := conf.Hotkeys
+	for _, k := range []struct {
+		action string
+		code   int
+	}{
+		{"reset", h.Reset},
+		{"pause", h.Pause},
+		{"frame_advance", h.FrameAdvance},
+		{"speed_up", h.SpeedUp},
+		{"speed_down", h.SpeedDown},
+		{"turbo", h.Turbo},
+		{"save_state", h.SaveState},
+		{"load_state", h.LoadState},
+		{"next_slot", h.NextSlot},
+		{"fast_forward", h.FastForward},
+		{"rewind", h.Rewind},
+		{"screenshot", h.Screenshot},
+		{"record", h.Record},
+		{"quit", h.Quit},
+	} {
+		list = append(list, keyBinding{name: "hotkey " + k.action, code: k.code, action: k.action})
+	}
+	return list
+}
+
+// checkKeys returns an error naming the first key bound twice
+func (conf *config) checkKeys() error {
+	bound := map[int]string{}
+	for _, k := range conf.keyBindings() {
+		if k.code == 0 {
+			continue
+		}
+		if other, ok := bound[k.code]; ok {
+			return fmt.Errorf("key %d is bound to both %s and %s", k.code, other, k.name)
+		}
+		bound[k.code] = k.name
+	}
+	return nil
+}
+
+// configure rebuild the key lookup tables from a config. Unbound keys are
+// skipped; should a key be bound twice, the first binding wins.
+func (in *input) configure(conf *config) {
+	in.Lock()
+	defer in.Unlock()
+	in.turboRate = conf.TurboRate
+	in.keys = map[int]binding{}
+	in.hotkeys = map[int]string{}
+	for _, k := range conf.keyBindings() {
+		if k.code == 0 {
+			continue
+		}
+		if _, ok := in.keys[k.code]; ok {
+			continue
+		}
+		if _, ok := in.hotkeys[k.code]; ok {
+			continue
+		}
+		if k.action != "" {
+			in.hotkeys[k.code] = k.action
+		} else {
+			in.keys[k.code] = k.button
+		}
+	}
+}
+
+// key handle a key press or release. It returns the hotkey action bound to
+// the key, or "" if the key is a controller button or unbound.
+func (in *input) key(code int, pressed bool) string {
+	in.Lock()
+	defer in.Unlock()
+	if action, ok := in.hotkeys[code]; ok {
+		return action
+	}
+	b, ok := in.keys[code]
+	if !ok {
+		return ""
+	}
+	c := &in.controllers[b.player]
+	if b.turbo {
+		c.turbo[b.button] = pressed
+	} else {
+		c.set(b.button, pressed)
+	}
+	return ""
+}
+
+// gamepad set the gamepad buttons of a controller from a bit mask: bits
+// 0-7 are A, B, Select, Start, Up, Down, Left, Right, bits 8-9 turbo A/B
+func (in *input) gamepad(player int, mask int) {
+	in.Lock()
+	defer in.Unlock()
+	c := &in.controllers[player]
+	for i := range c.pad {
+		c.pad[i] = mask&(1<<uint(i)) != 0
+	}
+	c.padTurbo[turboA] = mask&(1<<8) != 0
+	c.padTurbo[turboB] = mask&(1<<9) != 0
+}
+
+// nextFrame send both controllers' buttons to the console's joypads,
+// advancing the turbo buttons to the console's frame
+func (in *input) nextFrame(console *nes.Console) {
+	in.Lock()
+	defer in.Unlock()
+	for player := range in.controllers {
+		buttons := in.controllers[player].buttons(in.filterOpposing, console.Frame, in.turboRate)
+		console.CPU.Joypads[player].SetButtons(buttons)
+	}
+}
@@ -3,29 +3,50 @@ package main
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/json"
 	"flag"
 	"fmt"
-	"image"
 	"image/png"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
 
 	"github.com/shadow1163/logger"
 	"github.com/shadow1163/nes-go/step5/nes"
-	"github.com/zserge/webview"
 )
 
 var (
-	img    = image.NewRGBA(image.Rect(0, 0, 256, 240))
 	i      = 0
 	chrAll []byte
 	log    = logger.NewLogger()
 	dir    = ""
 	// events chan string
-	cpu *nes.CPU
-	ppu *nes.PPU
+	emu      *emulator
+	cart     *nes.Cartridge
+	romPath  string
+	savePath string
+	keys     input
+	settings *config
+
+	screenshotDir   string
+	screenshotScale int
+	screenshotCrop  bool
+	recordFormat    string
+)
+
+const (
+	// sramFlushFrames is how often (in frames) battery SRAM is flushed to disk
+	sramFlushFrames = 300
+	// fastForwardFrames is how many frames run per frame period while
+	// fast-forwarding
+	fastForwardFrames = 4
+	// stateSlots is the number of save state slots per ROM
+	stateSlots = 10
 )
 
 func init() {
@@ -43,7 +64,21 @@ func app(prefixChannel chan string) {
 
 	mux.Handle("/public/", http.StripPrefix("/public/", http.FileServer(http.Dir(dir+"/public"))))
 	mux.HandleFunc("/key/", captureKeys)
+	mux.HandleFunc("/pad/", captureGamepad)
 	mux.HandleFunc("/frame/", getFrame)
+	mux.HandleFunc("/screenshot", screenshot)
+	mux.HandleFunc("/record", record)
+	mux.HandleFunc("/rewind", rewind)
+	mux.HandleFunc("/pause", pause)
+	mux.HandleFunc("/speed", speed)
+	mux.HandleFunc("/movie", movie)
+	mux.HandleFunc("/cheats", cheatHandler)
+	mux.HandleFunc("/search", searchHandler)
+	mux.HandleFunc("/watch", watchHandler)
+	mux.HandleFunc("/debug", debugHandler)
+	mux.HandleFunc("/ws", frameSocket)
+	mux.HandleFunc("/disk/", changeDisk)
+	mux.HandleFunc("/config/", configHandler)
 
 	listener, err := net.Listen("tcp", "127.0.0.1:0")
 	if err != nil {
@@ -59,48 +94,185 @@ func app(prefixChannel chan string) {
 	server.ListenAndServe()
 }
 
-// capture keyboard events
+// capture keyboard events: /key?event=KEYCODE&state=down|up
 func captureKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache")
 	ev := r.FormValue("event")
+	pressed := r.FormValue("state") != "up"
 	log.Debug(ev)
-	// what to react to when the game is over
-	if ev == "81" { // q
-		os.Exit(0)
-	}
-	// events <- ev
-	var buttons [8]bool
-	switch ev {
-	case "88":
-		buttons[0] = true
-	case "90":
-		buttons[1] = true
-	case "16":
-		buttons[2] = true
-	case "13":
-		buttons[3] = true
-	case "38":
-		buttons[4] = true
-	case "40":
-		buttons[5] = true
-	case "37":
-		buttons[6] = true
-	case "39":
-		buttons[7] = true
-	default:
+	code, err := strconv.Atoi(ev)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	handleKey(code, pressed)
+}
+
+// handleKey press or release a controller button or hotkey
+func handleKey(code int, pressed bool) {
+	if action := keys.key(code, pressed); action != "" {
+		hotkey(action, pressed)
+	}
+}
+
+// capture gamepad state: /pad?player=0|1&buttons=MASK
+func captureGamepad(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache")
+	player, err := strconv.Atoi(r.FormValue("player"))
+	if err != nil || player < 0 || player > 1 {
+		http.Error(w, "player must be 0 or 1", http.StatusBadRequest)
+		return
+	}
+	mask, err := strconv.Atoi(r.FormValue("buttons"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	keys.gamepad(player, mask)
+}
+
+// hotkey perform a frontend action bound to a key
+func hotkey(action string, pressed bool) {
+	switch action {
+	case "fast_forward":
+		emu.Lock()
+		emu.fastForward = pressed
+		emu.Unlock()
+		return
+	case "rewind":
+		emu.Lock()
+		emu.rewinding = pressed && emu.rewind != nil
+		emu.Unlock()
+		return
 	}
-	cpu.Joypads[0].SetButtons(buttons)
+	if !pressed {
+		return
+	}
+	switch action {
+	case "reset":
+		emu.do(func(console *nes.Console) {
+			console.Reset()
+		})
+	case "pause":
+		emu.Lock()
+		emu.paused = !emu.paused
+		emu.Unlock()
+	case "frame_advance":
+		emu.Lock()
+		emu.frameAdvance()
+		emu.Unlock()
+	case "speed_up", "speed_down":
+		emu.Lock()
+		emu.stepSpeed(action == "speed_up")
+		emu.Unlock()
+	case "turbo":
+		emu.Lock()
+		emu.turbo = !emu.turbo
+		emu.Unlock()
+	case "screenshot":
+		saveScreenshot()
+	case "record":
+		emu.Lock()
+		defer emu.Unlock()
+		var err error
+		if emu.recorder != nil {
+			err = emu.stopRecording()
+		} else {
+			err = emu.startRecording(filepath.Join(screenshotDir, recordingName(romPath, emu.console.Frame, recordFormat)))
+		}
+		if err != nil {
+			log.Error(err)
+		}
+	case "save_state":
+		emu.Lock()
+		slot := emu.stateSlot
+		emu.Unlock()
+		if err := saveState(slot); err != nil {
+			log.Error(err)
+		}
+	case "load_state":
+		emu.Lock()
+		slot := emu.stateSlot
+		emu.Unlock()
+		if err := loadState(slot); err != nil {
+			log.Error(err)
+		}
+	case "next_slot":
+		emu.Lock()
+		emu.stateSlot = (emu.stateSlot + 1) % stateSlots
+		log.Info(fmt.Sprintf("save state slot %d", emu.stateSlot))
+		emu.Unlock()
+	case "quit":
+		// what to react to when the game is over
+		quit()
+	}
+}
+
+// configHandler get or replace the key bindings: GET /config, POST /config
+func configHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Cache-Control", "no-cache")
+	if r.Method == http.MethodPost {
+		conf := defaultConfig()
+		if err := json.NewDecoder(r.Body).Decode(conf); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if conf.TurboRate < 1 {
+			conf.TurboRate = 1
+		}
+		if err := conf.checkKeys(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := saveConfig(conf); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		settings = conf
+		keys.configure(settings)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
 }
 
-// getFrame
-func getFrame(w http.ResponseWriter, r *http.Request) {
-	for i := 0; i < 50000; i++ {
-		cpu.Step()
+// changeDisk eject, insert or flip the FDS disk: /disk?action=eject|next|insert&side=N
+func changeDisk(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-cache")
+	fds, ok := cart.Mapper.(*nes.FDS)
+	if !ok {
+		http.Error(w, "not a disk system game", http.StatusBadRequest)
+		return
+	}
+	emu.Lock()
+	defer emu.Unlock()
+	var err error
+	switch r.FormValue("action") {
+	case "eject":
+		fds.EjectDisk()
+	case "next":
+		err = fds.NextSide()
+	case "insert":
+		var side int
+		side, err = strconv.Atoi(r.FormValue("side"))
+		if err == nil {
+			err = fds.InsertDisk(side)
+		}
+	default:
+		err = fmt.Errorf("unknown disk action %q", r.FormValue("action"))
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
 	}
-	ppu.DoVBlank()
-	for i := 0; i < 256*240; i++ {
-		color := ppu.GetPixel(i%256, i>>8)
-		img.Set(i%256, i>>8, color)
+	fmt.Fprintf(w, "side %d of %d", fds.Side(), fds.NumSides())
+}
+
+// getFrame returns the latest frame as a PNG data URL
+func getFrame(w http.ResponseWriter, r *http.Request) {
+	img, _ := emu.frames.last()
+	if img == nil {
+		http.Error(w, "no frame yet", http.StatusServiceUnavailable)
+		return
 	}
 	var buf bytes.Buffer
 	png.Encode(&buf, img)
@@ -110,36 +282,294 @@ func getFrame(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte(str))
 }
 
+// pause control pausing: action=pause, resume, toggle or advance, which
+// runs one frame when paused
+func pause(w http.ResponseWriter, r *http.Request) {
+	emu.Lock()
+	defer emu.Unlock()
+	switch r.FormValue("action") {
+	case "pause":
+		emu.paused = true
+	case "resume":
+		emu.paused = false
+	case "toggle":
+		emu.paused = !emu.paused
+	case "advance":
+		emu.frameAdvance()
+	default:
+		http.Error(w, fmt.Sprintf("unknown pause action %q", r.FormValue("action")), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintf(w, "paused %v, frame %d", emu.paused, emu.console.Frame+emu.advance)
+}
+
+// speed set the speed: value=0.25 to 8 times normal, and turbo=1 to run
+// uncapped
+func speed(w http.ResponseWriter, r *http.Request) {
+	emu.Lock()
+	defer emu.Unlock()
+	if s := r.FormValue("value"); s != "" {
+		value, err := strconv.ParseFloat(s, 64)
+		if err == nil {
+			err = emu.setSpeed(value)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if s := r.FormValue("turbo"); s != "" {
+		turbo, err := strconv.ParseBool(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		emu.turbo = turbo
+	}
+	fmt.Fprintf(w, "speed %g%%, turbo %v", emu.speed*100, emu.turbo)
+}
+
+// statePath returns the save state file of a slot, next to the ROM
+func statePath(slot int) string {
+	return strings.TrimSuffix(romPath, filepath.Ext(romPath)) + fmt.Sprintf(".ss%d", slot)
+}
+
+// saveState save the machine to a slot
+func saveState(slot int) error {
+	var buf bytes.Buffer
+	emu.do(func(console *nes.Console) {
+		console.SaveState(&buf)
+	})
+	if err := nes.WriteFileAtomic(statePath(slot), buf.Bytes()); err != nil {
+		return err
+	}
+	log.Info(fmt.Sprintf("saved state %d", slot))
+	return nil
+}
+
+// loadState restore the machine from a slot
+func loadState(slot int) error {
+	data, err := os.ReadFile(statePath(slot))
+	if err != nil {
+		return err
+	}
+	emu.do(func(console *nes.Console) {
+		err = console.LoadState(bytes.NewReader(data))
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %v", statePath(slot), err)
+	}
+	log.Info(fmt.Sprintf("loaded state %d", slot))
+	return nil
+}
+
+// chooseEntry ask on the terminal which ROM of an archive to load
+func chooseEntry(names []string) (string, error) {
+	for i, name := range names {
+		fmt.Printf("%2d) %s\n", i+1, name)
+	}
+	fmt.Print("Choose a ROM: ")
+	var n int
+	if _, err := fmt.Scanln(&n); err != nil {
+		return "", err
+	}
+	if n < 1 || n > len(names) {
+		return "", fmt.Errorf("no ROM number %d", n)
+	}
+	return names[n-1], nil
+}
+
+// flushSRAM write battery-backed SRAM to the save file if it changed
+func flushSRAM() {
+	if err := cart.FlushSRAM(savePath); err != nil {
+		log.Error(err)
+	}
+}
+
+// quit flush SRAM and any recording and exit, with the emulation stopped
+func quit() {
+	if emu != nil {
+		emu.Lock()
+		if err := emu.stopRecording(); err != nil {
+			log.Error(err)
+		}
+	}
+	flushSRAM()
+	os.Exit(0)
+}
+
+// romOptions are the flags controlling how a ROM is loaded, shared by the
+// frontend and the headless runner
+type romOptions struct {
+	gameDB    *string
+	entry     *string
+	patch     *string
+	autoPatch *bool
+	bios      *string
+}
+
+// addROMFlags register the ROM loading flags
+func addROMFlags(flags *flag.FlagSet) *romOptions {
+	return &romOptions{
+		gameDB:    flags.String("db", "", "game database file (NES 2.0 XML or JSON)"),
+		entry:     flags.String("entry", "", "ROM to load when an archive holds several"),
+		patch:     flags.String("patch", "", "IPS, BPS or UPS patch to apply to the ROM"),
+		autoPatch: flags.Bool("autopatch", true, "apply a patch file found next to the ROM"),
+		bios:      flags.String("bios", "", "FDS BIOS image (default disksys.rom next to the program)"),
+	}
+}
+
+// parseFlags parse the flags of a subcommand wherever they are, before or
+// after the file names, and returns the file names. Everything after "--"
+// is a file name.
+func parseFlags(flags *flag.FlagSet, args []string) ([]string, error) {
+	var names []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		rest := flags.Args()
+		if used := len(args) - len(rest); used > 0 && args[used-1] == "--" {
+			return append(names, rest...), nil
+		}
+		if len(rest) == 0 {
+			return names, nil
+		}
+		names = append(names, rest[0])
+		args = rest[1:]
+	}
+}
+
+// load the game database and FDS BIOS, then the ROM. With prompt, the user
+// is asked which ROM to load from an archive holding several.
+func (opts *romOptions) load(filename string, prompt bool) (*nes.Cartridge, error) {
+	if *opts.gameDB != "" {
+		if err := nes.LoadGameDB(*opts.gameDB); err != nil {
+			return nil, err
+		}
+	}
+	if *opts.bios != "" {
+		if err := nes.LoadFDSBIOS(*opts.bios); err != nil {
+			return nil, err
+		}
+	} else if _, err := os.Stat(dir + "/disksys.rom"); err == nil {
+		if err = nes.LoadFDSBIOS(dir + "/disksys.rom"); err != nil {
+			log.Error(err)
+		}
+	}
+	choose := nes.ChooseEntry
+	nes.ChooseEntry = func(names []string) (string, error) {
+		if *opts.entry != "" {
+			return *opts.entry, nil
+		}
+		if prompt {
+			return chooseEntry(names)
+		}
+		return choose(names)
+	}
+	patchFile := *opts.patch
+	if patchFile == "" && *opts.autoPatch {
+		patchFile = nes.FindPatch(filename)
+	}
+	return nes.LoadPatchedCartridge(filename, patchFile)
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "run" {
+		os.Exit(runHeadless(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "disasm" {
+		os.Exit(runDisasm(os.Args[2:]))
+	}
+
+	rom := addROMFlags(flag.CommandLine)
+	filterDpad := flag.Bool("filter-dpad", true, "never report opposing D-pad directions held together")
+	region := flag.String("region", "auto", "frame rate: auto (from the ROM), ntsc or pal")
+	movieFile := flag.String("movie", "", "play a .fm2 or .nesm input movie")
+	speedFactor := flag.Float64("speed", 1, "emulation speed, 0.25 to 8 times normal")
+	rewindSeconds := flag.Float64("rewind-seconds", 30, "seconds of play kept for rewinding, 0 disables rewind")
+	rewindInterval := flag.Int("rewind-interval", 4, "frames between two rewind states")
+	rewindMB := flag.Int("rewind-mb", 64, "memory limit of the rewind buffer in MB")
+	flag.StringVar(&screenshotDir, "screenshot-dir", ".", "directory to save screenshots in")
+	flag.IntVar(&screenshotScale, "scale", 1, "screenshot scale factor")
+	flag.BoolVar(&screenshotCrop, "crop", false, "crop the screenshot overscan")
+	flag.StringVar(&recordFormat, "record-format", "gif", "format of recordings started by the hotkey: gif, apng or y4m")
 	flag.Parse()
 
 	var args []string = flag.Args()
 
 	if len(args) != 1 {
 		fmt.Println("Usage: nes FILENAME.ROM")
+		fmt.Println("       nes run [flags] FILENAME.ROM")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
-	cart, err := nes.LoadCartridge(args[0])
+	var err error
+	keys.filterOpposing = *filterDpad
+	settings, err = loadConfig()
+	if err != nil {
+		log.Error(err)
+	}
+	keys.configure(settings)
+	cart, err = rom.load(args[0], true)
 	if err != nil {
 		log.Error(err)
 		os.Exit(1)
 	}
-	cpu = nes.NewCPU(cart)
-	ppu = nes.NewPPU(cart, cpu)
-	cpu.PPU = ppu
-	for i := range cpu.Joypads {
-		cpu.Joypads[i] = nes.NewJoypad()
+	romPath = args[0]
+	savePath = nes.SavePath(args[0])
+	if cart.Battery {
+		err = cart.LoadSRAM(savePath)
+		if err != nil && !os.IsNotExist(err) {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-signals
+		quit()
+	}()
+	var frameRate float64
+	switch *region {
+	case "ntsc":
+		frameRate = nes.FrameRateNTSC
+	case "pal":
+		frameRate = nes.FrameRatePAL
 	}
+	emu = newEmulator(nes.NewConsole(cart), frameRate)
+	if err = loadCheats(cart.SHA1); err != nil {
+		log.Error(err)
+	}
+	emu.console.SetCheats(enabledCheats())
+	if err = emu.setSpeed(*speedFactor); err != nil {
+		log.Error(err)
+		os.Exit(1)
+	}
+	if *movieFile != "" {
+		var movie *nes.Movie
+		movie, err = nes.LoadMovie(*movieFile)
+		if err == nil {
+			err = emu.console.PlayMovie(movie)
+		}
+		if err != nil {
+			log.Error(err)
+			os.Exit(1)
+		}
+	}
+	if *rewindSeconds > 0 {
+		emu.rewind = newRewindBuffer(*rewindSeconds, emu.frameRate, *rewindInterval, *rewindMB<<20)
+	}
+	go emu.run()
 
 	prefixChannel := make(chan string)
 	go app(prefixChannel)
 	prefix := <-prefixChannel
 	// create a web view
 	log.Debug(prefix)
-	err = webview.Open("nes step5", prefix+"/public/html/index.html",
-		600, 400, false)
-	if err != nil {
+	if err := openWindow(prefix + "/public/html/index.html"); err != nil {
 		log.Fatal(err)
 	}
+	quit()
 }
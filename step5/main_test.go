@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestParseFlags(t *testing.T) {
+	tests := []struct {
+		args  []string
+		names []string
+		n     int
+		debug bool
+	}{
+		{[]string{"rom.nes"}, []string{"rom.nes"}, 600, false},
+		{[]string{"-frames", "5", "rom.nes"}, []string{"rom.nes"}, 5, false},
+		{[]string{"rom.nes", "-frames", "5"}, []string{"rom.nes"}, 5, false},
+		{[]string{"rom.nes", "--frames=5", "-debug"}, []string{"rom.nes"}, 5, true},
+		{[]string{"-debug", "a.nes", "-frames", "7", "b.nes"}, []string{"a.nes", "b.nes"}, 7, true},
+		{[]string{"-frames", "3", "--", "-debug", "rom.nes"}, []string{"-debug", "rom.nes"}, 3, false},
+		{nil, nil, 600, false},
+	}
+	for _, test := range tests {
+		flags := flag.NewFlagSet("run", flag.ContinueOnError)
+		flags.SetOutput(io.Discard)
+		n := flags.Int("frames", 600, "")
+		debug := flags.Bool("debug", false, "")
+		names, err := parseFlags(flags, test.args)
+		if err != nil {
+			t.Errorf("%q: %v", test.args, err)
+			continue
+		}
+		if !reflect.DeepEqual(names, test.names) || *n != test.n || *debug != test.debug {
+			t.Errorf("%q: names %q frames %d debug %v, want %q %d %v",
+				test.args, names, *n, *debug, test.names, test.n, test.debug)
+		}
+	}
+}
+
+func TestParseFlagsError(t *testing.T) {
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	flags.Int("frames", 600, "")
+	if _, err := parseFlags(flags, []string{"rom.nes", "-frames", "x"}); err == nil {
+		t.Error("bad -frames value accepted")
+	}
+}
+
+func TestRunFlagsAfterROM(t *testing.T) {
+	if status := runHeadless([]string{"nestest.nes", "-frames", "2", "-autopatch=false"}); status != 0 {
+		t.Errorf("nes run nestest.nes -frames 2: status %d", status)
+	}
+}
+
+func TestDisasmFlagsAfterROM(t *testing.T) {
+	stdout := os.Stdout
+	os.Stdout, _ = os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	defer func() { os.Stdout = stdout }()
+	if status := runDisasm([]string{"nestest.nes", "--bank", "0", "--org", "$8000", "-autopatch=false"}); status != 0 {
+		t.Errorf("nes disasm nestest.nes --bank 0 --org $8000: status %d", status)
+	}
+}
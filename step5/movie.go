@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/shadow1163/nes-go/step5/nes"
+)
+
+// moviePath returns the file a recorded movie is saved to, next to the ROM
+func moviePath(format string) string {
+	return strings.TrimSuffix(romPath, filepath.Ext(romPath)) + "." + format
+}
+
+// movie control input movies: action=record from=power or state starts
+// recording, action=play file=NAME plays a .fm2 or .nesm movie, and
+// action=stop ends either, saving a recording as format=fm2 or nesm next
+// to the ROM
+func movie(w http.ResponseWriter, r *http.Request) {
+	emu.Lock()
+	defer emu.Unlock()
+	console := emu.console
+	switch r.FormValue("action") {
+	case "record":
+		console.StopMovie()
+		console.RecordMovie(romPath, r.FormValue("from") == "state")
+	case "play":
+		movie, err := nes.LoadMovie(r.FormValue("file"))
+		if err == nil {
+			console.StopMovie()
+			err = console.PlayMovie(movie)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case "stop":
+		status, _, _ := console.MovieStatus()
+		movie := console.StopMovie()
+		if status == "recording" {
+			format := r.FormValue("format")
+			if format == "" {
+				format = "fm2"
+			}
+			if format != "fm2" && format != "nesm" {
+				http.Error(w, fmt.Sprintf("unknown movie format %q", format), http.StatusBadRequest)
+				return
+			}
+			if err := movie.SaveMovie(moviePath(format)); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			fmt.Fprintf(w, "saved %s, ", moviePath(format))
+		}
+	case "status":
+	default:
+		http.Error(w, fmt.Sprintf("unknown movie action %q", r.FormValue("action")), http.StatusBadRequest)
+		return
+	}
+	status, frame, frames := console.MovieStatus()
+	if status == "" {
+		status = "no movie"
+	}
+	fmt.Fprintf(w, "%s %d/%d, %d lag frames", status, frame, frames, console.LagFrames)
+}
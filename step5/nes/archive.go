@@ -0,0 +1,107 @@
+package nes
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// romExtensions are the archive entries considered to be ROM images
+var romExtensions = []string{".nes", ".nsf", ".fds", ".unf", ".unif"}
+
+// ChooseEntry is called when an archive holds more than one ROM image and
+// returns the name of the entry to load. The default takes the first one.
+var ChooseEntry = func(names []string) (string, error) {
+	return names[0], nil
+}
+
+// ReadROMFile read a ROM image from disk. Zip archives and gzip files are
+// unpacked in memory; anything else is returned as is.
+func ReadROMFile(filename string) ([]byte, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		return readZip(data)
+	case bytes.HasPrefix(data, []byte{0x1f, 0x8b}):
+		return readGzip(data)
+	}
+	return data, nil
+}
+
+// isROMName reports whether name has one of the known ROM extensions
+func isROMName(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, e := range romExtensions {
+		if ext == e {
+			return true
+		}
+	}
+	return false
+}
+
+func readZip(data []byte) ([]byte, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	entries := map[string]*zip.File{}
+	for _, f := range archive.File {
+		if f.FileInfo().IsDir() || !isROMName(f.Name) {
+			continue
+		}
+		names = append(names, f.Name)
+		entries[f.Name] = f
+	}
+	if len(names) == 0 {
+		return nil, errors.New("no ROM image found in zip archive")
+	}
+	name := names[0]
+	if len(names) > 1 {
+		if name, err = ChooseEntry(names); err != nil {
+			return nil, err
+		}
+	}
+	f, ok := entries[name]
+	if !ok {
+		return nil, fmt.Errorf("zip archive has no ROM entry %q", name)
+	}
+	log.Debug("loading " + name + " from zip archive")
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return readLimited(rc)
+}
+
+func readGzip(data []byte) ([]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	return readLimited(gz)
+}
+
+// readLimited read an uncompressed ROM image, failing on anything larger
+// than a ROM can be so a small archive cannot exhaust the memory
+func readLimited(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxROMSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxROMSize {
+		return nil, fmt.Errorf("unpacked ROM image is larger than %d bytes", maxROMSize)
+	}
+	return data, nil
+}
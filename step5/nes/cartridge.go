@@ -1,16 +1,19 @@
 package nes
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"io"
-	"os"
 
 	"github.com/shadow1163/logger"
 )
 
 var log = logger.NewLogger()
 
+// maxROMSize is the largest ROM image accepted, well above any real one
+const maxROMSize = 16 << 20
+
 // MirrorType mirror type
 type MirrorType int
 
@@ -29,13 +32,38 @@ type Cartridge struct {
 	PRG    [][]byte // [bank][byte], 16k banks.
 	CHR    [][]byte // [bank][byte], 8k banks.
 	SRAM   [][]byte // [bank][byte], 8k banks.
+
+	// Battery is set when SRAM is battery-backed and should be persisted.
+	Battery bool
+
+	// Header or game database derived board information.
+	MapperID  int
+	Submapper int
+	Region    Region
+	Title     string
+
+	// Hashes of PRG-ROM followed by CHR-ROM, upper case hex.
+	CRC32 string
+	SHA1  string
+
+	// Trainer is the 512-byte trainer from the ROM file, nil if absent.
+	// It is mapped into PRG-RAM at $7000-$71FF.
+	Trainer []byte
+
+	// CHRRAM is set when the cartridge has no CHR-ROM and CHR is writable RAM.
+	CHRRAM bool
+
+	// SRAM contents at the last load or save, used to skip needless writes.
+	savedSRAM []byte
 }
 
 // NewCartridge new a cartridge
 func NewCartridge(numPRGBanks int, numCHRBanks int, numSRAMBanks int) *Cartridge {
 	cart := &Cartridge{}
 	if numCHRBanks == 0 {
+		// No CHR-ROM means the board carries 8KB of CHR-RAM instead.
 		numCHRBanks = 1
+		cart.CHRRAM = true
 	}
 	if numSRAMBanks == 0 {
 		numSRAMBanks = 1
@@ -60,15 +88,44 @@ func NewCartridge(numPRGBanks int, numCHRBanks int, numSRAMBanks int) *Cartridge
 	return cart
 }
 
-// LoadCartridge open and read an iNES format ROM file
+// LoadCartridge open and read an iNES format ROM file. The ROM may be
+// stored in a .zip or .gz archive.
 func LoadCartridge(filename string) (*Cartridge, error) {
-	file, err := os.Open(filename)
+	return LoadPatchedCartridge(filename, "")
+}
+
+// LoadPatchedCartridge open a ROM file like LoadCartridge and apply an
+// IPS, BPS or UPS patch file to it in memory before parsing. No patch is
+// applied if patchFile is empty.
+func LoadPatchedCartridge(filename string, patchFile string) (*Cartridge, error) {
+	data, err := ReadROMFile(filename)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
+	if patchFile != "" {
+		if data, err = ApplyPatchFile(data, patchFile); err != nil {
+			return nil, err
+		}
+	}
+	return ParseCartridge(data)
+}
+
+// ParseCartridge read a ROM image held in memory. iNES and UNIF ROMs and
+// FDS disk images are supported.
+func ParseCartridge(data []byte) (*Cartridge, error) {
+	if isFDSImage(data) {
+		return LoadFDS(data)
+	}
+	if bytes.HasPrefix(data, []byte("UNIF")) {
+		return LoadUNIF(data)
+	}
+	return LoadCartridgeFrom(bytes.NewReader(data))
+}
+
+// LoadCartridgeFrom read an iNES format ROM image from r
+func LoadCartridgeFrom(file io.Reader) (*Cartridge, error) {
 	header := iNESHeader{}
-	err = binary.Read(file, binary.LittleEndian, &header)
+	err := binary.Read(file, binary.LittleEndian, &header)
 	if err != nil {
 		return nil, err
 	}
@@ -84,19 +141,23 @@ func LoadCartridge(filename string) (*Cartridge, error) {
 	}
 
 	cart := NewCartridge(int(header.NumPRGBanks), int(header.NumCHRBanks), int(header.NumSRAMBanks))
-	if header.Control1&0x02 != 0 {
+	// Control1 bits: 0 mirroring, 1 battery, 2 trainer, 3 four-screen.
+	if header.Control1&0x08 != 0 {
 		cart.Mirror = fourScreen
 	} else if header.Control1&0x01 != 0 {
 		cart.Mirror = vertical
 	} else {
 		cart.Mirror = horizontal
 	}
+	cart.Battery = header.Control1&0x02 != 0
 	hasTrainer := header.Control1&0x04 != 0
 	if hasTrainer {
-		buf := make([]byte, 512)
-		if _, err := io.ReadFull(file, buf); err != nil {
+		cart.Trainer = make([]byte, 512)
+		if _, err := io.ReadFull(file, cart.Trainer); err != nil {
 			return nil, err
 		}
+		// $7000 is offset 0x1000 into the first 8KB SRAM bank at $6000.
+		copy(cart.SRAM[0][0x1000:], cart.Trainer)
 	}
 	for i := range cart.PRG {
 		n, err := io.ReadFull(file, cart.PRG[i])
@@ -117,20 +178,27 @@ func LoadCartridge(filename string) (*Cartridge, error) {
 			}
 		}
 	}
-	mapperID := int((header.Control1 >> 4) | (header.Control2 & 0xf0))
+	cart.MapperID = int((header.Control1 >> 4) | (header.Control2 & 0xf0))
 	log.Printf("header control1: %b", header.Control1)
 	log.Printf("header control2: %d", header.Control2)
-	log.Printf("ROM: PRG-RPM: %d x 16KB  CHR-ROM %d x 8KB Mapper: %d", header.NumPRGBanks, header.NumCHRBanks, mapperID)
-	// log.Info(mapperID)
-	// For nestest.nes
-	if mapperID == 171 {
-		log.Debug("nestest.nes file")
-		mapperID = 0
-	}
-	cart.Mapper, err = NewMapper(mapperID, cart)
-	if err != nil {
+	log.Printf("ROM: PRG-RPM: %d x 16KB  CHR-ROM %d x 8KB Mapper: %d", header.NumPRGBanks, header.NumCHRBanks, cart.MapperID)
+	log.Printf("ROM: mirror: %d battery: %v trainer: %v CHR-RAM: %v", cart.Mirror, cart.Battery, hasTrainer, cart.CHRRAM)
+	if err := cart.setupMapper(); err != nil {
 		return nil, err
 	}
-
 	return cart, nil
 }
+
+// setupMapper correct known dumps from the game database, then create the
+// mapper for MapperID
+func (cart *Cartridge) setupMapper() error {
+	// Headers are often wrong, known dumps are corrected from the database.
+	cart.hashROM()
+	log.Printf("ROM: CRC32: %s SHA-1: %s", cart.CRC32, cart.SHA1)
+	if game := LookupGame(cart.CRC32, cart.SHA1); game != nil {
+		cart.applyGameInfo(game)
+	}
+	var err error
+	cart.Mapper, err = NewMapper(cart.MapperID, cart)
+	return err
+}
@@ -0,0 +1,151 @@
+package nes
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Cheat is a decoded cheat code. Codes for $8000-$FFFF patch what the CPU
+// reads from ROM, optionally only while the ROM holds Compare; lower
+// addresses are RAM freezes, written before every frame.
+type Cheat struct {
+	Code       string
+	Address    uint16
+	Value      byte
+	Compare    byte
+	HasCompare bool
+}
+
+// gameGenieLetters are the Game Genie letters, in the order of the values
+// they encode
+const gameGenieLetters = "APZLGITYEOXUKSVN"
+
+// ParseCheat decode a cheat code, one of
+//
+//	SXIOPO        6 letter Game Genie
+//	SXIOPOVK      8 letter Game Genie, with a compare value
+//	0075:09       raw address:value, a RAM freeze below $8000
+//	C5AF?A9:EA    raw address?compare:value
+func ParseCheat(code string) (*Cheat, error) {
+	code = strings.ToUpper(strings.TrimSpace(code))
+	if strings.Contains(code, ":") {
+		return parseRawCheat(code)
+	}
+	return parseGameGenie(code)
+}
+
+func parseGameGenie(code string) (*Cheat, error) {
+	if len(code) != 6 && len(code) != 8 {
+		return nil, fmt.Errorf("cheat %q: Game Genie codes have 6 or 8 letters", code)
+	}
+	var n [8]uint16
+	for i := 0; i < len(code); i++ {
+		v := strings.IndexByte(gameGenieLetters, code[i])
+		if v < 0 {
+			return nil, fmt.Errorf("cheat %q: %q is not a Game Genie letter, use %s", code, code[i], gameGenieLetters)
+		}
+		n[i] = uint16(v)
+	}
+	// The third letter tells the Game Genie the code length.
+	if long := n[2]&8 != 0; long != (len(code) == 8) {
+		if long {
+			return nil, fmt.Errorf("cheat %q: the third letter of a 6 letter code must be one of APZLGITY", code)
+		}
+		return nil, fmt.Errorf("cheat %q: the third letter of an 8 letter code must be one of EOXUKSVN", code)
+	}
+	cheat := &Cheat{Code: code}
+	cheat.Address = 0x8000 | (n[3]&7)<<12 | (n[5]&7)<<8 | (n[4]&8)<<8 |
+		(n[2]&7)<<4 | (n[1]&8)<<4 | n[4]&7 | n[3]&8
+	value := (n[1]&7)<<4 | (n[0]&8)<<4 | n[0]&7
+	if len(code) == 6 {
+		value |= n[5] & 8
+	} else {
+		value |= n[7] & 8
+		cheat.Compare = byte((n[7]&7)<<4 | (n[6]&8)<<4 | n[6]&7 | n[5]&8)
+		cheat.HasCompare = true
+	}
+	cheat.Value = byte(value)
+	return cheat, nil
+}
+
+func parseRawCheat(code string) (*Cheat, error) {
+	fields := strings.Split(code, ":")
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("cheat %q: want ADDRESS:VALUE or ADDRESS?COMPARE:VALUE", code)
+	}
+	cheat := &Cheat{Code: code}
+	address := fields[0]
+	if i := strings.IndexByte(address, '?'); i >= 0 {
+		compare, err := strconv.ParseUint(address[i+1:], 16, 8)
+		if err != nil {
+			return nil, fmt.Errorf("cheat %q: bad compare value %q", code, address[i+1:])
+		}
+		cheat.Compare, cheat.HasCompare = byte(compare), true
+		address = address[:i]
+	}
+	a, err := strconv.ParseUint(address, 16, 16)
+	if err != nil {
+		return nil, fmt.Errorf("cheat %q: bad address %q", code, address)
+	}
+	v, err := strconv.ParseUint(fields[1], 16, 8)
+	if err != nil {
+		return nil, fmt.Errorf("cheat %q: bad value %q", code, fields[1])
+	}
+	cheat.Address, cheat.Value = uint16(a), byte(v)
+	if cheat.HasCompare && cheat.Address < 0x8000 {
+		return nil, fmt.Errorf("cheat %q: compare values only work on ROM, $8000-$FFFF", code)
+	}
+	if cheat.Address >= 0x2000 && cheat.Address < 0x6000 {
+		return nil, fmt.Errorf("cheat %q: only RAM, $0000-$1FFF, SRAM, $6000-$7FFF, and ROM can be changed", code)
+	}
+	return cheat, nil
+}
+
+// String returns the cheat in the raw form
+func (cheat *Cheat) String() string {
+	if cheat.HasCompare {
+		return fmt.Sprintf("%04X?%02X:%02X", cheat.Address, cheat.Compare, cheat.Value)
+	}
+	return fmt.Sprintf("%04X:%02X", cheat.Address, cheat.Value)
+}
+
+// romPatch replace a ROM byte as the CPU reads it
+type romPatch struct {
+	value      byte
+	compare    byte
+	hasCompare bool
+}
+
+// SetCheats replace the active cheats
+func (console *Console) SetCheats(cheats []*Cheat) {
+	console.patches = nil
+	console.freezes = nil
+	for _, cheat := range cheats {
+		if cheat.Address < 0x8000 {
+			console.freezes = append(console.freezes, cheat)
+			continue
+		}
+		if console.patches == nil {
+			console.patches = map[uint16]romPatch{}
+		}
+		console.patches[cheat.Address] = romPatch{cheat.Value, cheat.Compare, cheat.HasCompare}
+	}
+	console.CPU.patches = console.patches
+}
+
+// applyFreezes write the RAM freeze cheats straight to RAM and SRAM, so
+// they never reach a register or a debugger breakpoint
+func (console *Console) applyFreezes() {
+	for _, cheat := range console.freezes {
+		switch {
+		case cheat.Address < 0x2000:
+			console.CPU.RAM[cheat.Address%0x0800] = cheat.Value
+		case cheat.Address >= 0x6000 && cheat.Address < 0x8000:
+			offset := int(cheat.Address - 0x6000)
+			if offset/8192 < len(console.Cart.SRAM) {
+				console.Cart.SRAM[offset/8192][offset%8192] = cheat.Value
+			}
+		}
+	}
+}
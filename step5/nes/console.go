@@ -0,0 +1,188 @@
+package nes
+
+import (
+	"image"
+	"image/color"
+)
+
+// Frame rates of the NTSC and PAL consoles, in frames per second.
+const (
+	FrameRateNTSC = 60.0988
+	FrameRatePAL  = 50.0070
+)
+
+// stepsPerFrame is how many CPU instructions run between two vblanks
+const stepsPerFrame = 50000
+
+// SampleRate is the rate of the audio samples returned by Samples
+const SampleRate = 44100
+
+// Console nes console, the CPU and PPU wired to a cartridge
+type Console struct {
+	Cart *Cartridge
+	CPU  *CPU
+	PPU  *PPU
+
+	// Frame counter.
+	Frame int
+	// Lag is set when the game did not read the joypads during the last
+	// frame, LagFrames counts such frames.
+	Lag       bool
+	LagFrames int
+
+	// command holds a reset or power cycle to do before the next frame
+	command byte
+	movie   movieState
+	// a debugger can stop a frame half way: inFrame is set once the frame
+	// started, with frameCommand, and frameStep counts its instructions
+	inFrame      bool
+	frameStep    int
+	frameCommand byte
+	debugger     *Debugger
+	// active cheats, see SetCheats
+	patches map[uint16]romPatch
+	freezes []*Cheat
+
+	buffer *image.RGBA
+	// audio samples of the last frame, sampleTime counts towards the
+	// next one
+	samples    []float32
+	sampleTime float64
+}
+
+// NewConsole create a console for a cartridge
+func NewConsole(cart *Cartridge) *Console {
+	console := &Console{
+		Cart:   cart,
+		buffer: image.NewRGBA(image.Rect(0, 0, 256, 240)),
+	}
+	console.power()
+	return console
+}
+
+// power replace the CPU, PPU and joypads with fresh ones, as when the
+// console is switched on. The cartridge keeps its memory.
+func (console *Console) power() {
+	cpu := NewCPU(console.Cart)
+	ppu := NewPPU(console.Cart, cpu)
+	cpu.PPU = ppu
+	for i := range cpu.Joypads {
+		cpu.Joypads[i] = NewJoypad()
+	}
+	cpu.patches = console.patches
+	cpu.debugger = console.debugger
+	console.CPU, console.PPU = cpu, ppu
+}
+
+// Reset press the reset button, which takes effect at the start of the
+// next frame so movies can record it
+func (console *Console) Reset() {
+	console.command |= MovieReset
+}
+
+// StepFrame run the console for one frame. With a debugger attached it
+// returns early when the debugger breaks, and the following calls finish
+// the frame once it resumes.
+func (console *Console) StepFrame() {
+	if !console.inFrame {
+		console.startFrame()
+	}
+	audio, _ := console.Cart.Mapper.(AudioMapper)
+	samplesPerStep := SampleRate / console.FrameRate() / stepsPerFrame
+	for console.frameStep < stepsPerFrame {
+		d := console.debugger
+		// the debugger must see the instruction that runs next, the first
+		// of the handler when an interrupt is pending
+		console.CPU.serviceInterrupt()
+		if d != nil && d.breakBefore() {
+			return
+		}
+		console.CPU.Step()
+		console.frameStep++
+		console.sampleTime += samplesPerStep
+		if console.sampleTime >= 1 {
+			console.sampleTime--
+			var sample float32
+			if audio != nil {
+				sample = audio.AudioOutput()
+			}
+			console.samples = append(console.samples, sample)
+		}
+		if d != nil && d.breakAfter() {
+			return
+		}
+	}
+	console.inFrame = false
+	console.frameStep = 0
+	console.PPU.DoVBlank()
+	console.Lag = !console.CPU.inputRead
+	if console.Lag {
+		console.LagFrames++
+	}
+	console.movieAfterFrame(console.frameCommand)
+	console.Frame++
+}
+
+// startFrame apply the input of a movie, a pending reset or power cycle
+// and the cheats before the first instruction of a frame
+func (console *Console) startFrame() {
+	console.movieBeforeFrame()
+	command := console.command
+	console.command = 0
+	console.inFrame = true
+	console.frameCommand = command
+	switch {
+	case command&MoviePower != 0:
+		buttons := [2][8]bool{console.CPU.Joypads[0].buttons, console.CPU.Joypads[1].buttons}
+		console.power()
+		console.CPU.Joypads[0].buttons, console.CPU.Joypads[1].buttons = buttons[0], buttons[1]
+	case command&MovieReset != 0:
+		console.CPU.Reset()
+	}
+	console.CPU.inputRead = false
+	console.applyFreezes()
+	console.samples = console.samples[:0]
+}
+
+// Buffer render the screen, 256x240px
+func (console *Console) Buffer() *image.RGBA {
+	for i := 0; i < 256*240; i++ {
+		console.buffer.SetRGBA(i%256, i>>8, console.PPU.GetPixel(i%256, i>>8))
+	}
+	return console.buffer
+}
+
+// Samples returns the audio of the last frame, mono in [0, 1] at
+// SampleRate. Only expansion audio is produced, there is no APU yet.
+func (console *Console) Samples() []float32 {
+	return console.samples
+}
+
+// Palette returns the 64 colours the console can show
+func (console *Console) Palette() color.Palette {
+	palette := make(color.Palette, len(console.PPU.palette))
+	for i, c := range console.PPU.palette {
+		palette[i] = c
+	}
+	return palette
+}
+
+// FrameRate returns the frame rate for the cartridge region
+func (console *Console) FrameRate() float64 {
+	if console.Cart.Region == RegionPAL || console.Cart.Region == RegionDendy {
+		return FrameRatePAL
+	}
+	return FrameRateNTSC
+}
+
+// Peek read memory like the CPU does, without the side effects of reading
+// registers. Registers and expansion space read as 0.
+func (console *Console) Peek(address uint16) byte {
+	switch {
+	case address < 0x2000:
+		return console.CPU.RAM[address%0x0800]
+	case address < 0x6000:
+		return 0
+	}
+	return console.Cart.Mapper.Read(address)
+}
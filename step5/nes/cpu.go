@@ -1,23 +1,29 @@
 package nes
 
-import "fmt"
+import "github.com/shadow1163/nes-go/step5/disasm"
+
+// interrupt types
+const (
+	interruptNone = iota
+	interruptNMI
+	interruptIRQ
+)
 
 // addressing modes
 const (
-	_ = iota
-	modeAbsolute
-	modeAbsoluteX
-	modeAbsoluteY
-	modeAccumulator
-	modeImmediate
-	modeImplied
-	modeIndexedIndirect
-	modeIndirect
-	modeIndirectIndexed
-	modeRelative
-	modeZeroPage
-	modeZeroPageX
-	modeZeroPageY
+	modeAbsolute        = disasm.Absolute
+	modeAbsoluteX       = disasm.AbsoluteX
+	modeAbsoluteY       = disasm.AbsoluteY
+	modeAccumulator     = disasm.Accumulator
+	modeImmediate       = disasm.Immediate
+	modeImplied         = disasm.Implied
+	modeIndexedIndirect = disasm.IndexedIndirect
+	modeIndirect        = disasm.Indirect
+	modeIndirectIndexed = disasm.IndirectIndexed
+	modeRelative        = disasm.Relative
+	modeZeroPage        = disasm.ZeroPage
+	modeZeroPageX       = disasm.ZeroPageX
+	modeZeroPageY       = disasm.ZeroPageY
 )
 
 // CPU nes cpu struct
@@ -43,6 +49,9 @@ type CPU struct {
 	N         byte // negative flag
 	interrupt byte // interrupt type to perform
 	stall     int  // number of cycles to stall
+	inputRead bool // the joypads were read, see Console.Lag
+	patches   map[uint16]romPatch
+	debugger  *Debugger
 	table     [256]func(*stepInfo)
 }
 
@@ -53,45 +62,12 @@ type stepInfo struct {
 	mode    byte
 }
 
-// instructionModes indicates the addressing mode for each instruction
-var instructionModes = [256]byte{
-	6, 7, 6, 7, 11, 11, 11, 11, 6, 5, 4, 5, 1, 1, 1, 1,
-	10, 9, 6, 9, 12, 12, 12, 12, 6, 3, 6, 3, 2, 2, 2, 2,
-	1, 7, 6, 7, 11, 11, 11, 11, 6, 5, 4, 5, 1, 1, 1, 1,
-	10, 9, 6, 9, 12, 12, 12, 12, 6, 3, 6, 3, 2, 2, 2, 2,
-	6, 7, 6, 7, 11, 11, 11, 11, 6, 5, 4, 5, 1, 1, 1, 1,
-	10, 9, 6, 9, 12, 12, 12, 12, 6, 3, 6, 3, 2, 2, 2, 2,
-	6, 7, 6, 7, 11, 11, 11, 11, 6, 5, 4, 5, 8, 1, 1, 1,
-	10, 9, 6, 9, 12, 12, 12, 12, 6, 3, 6, 3, 2, 2, 2, 2,
-	5, 7, 5, 7, 11, 11, 11, 11, 6, 5, 6, 5, 1, 1, 1, 1,
-	10, 9, 6, 9, 12, 12, 13, 13, 6, 3, 6, 3, 2, 2, 3, 3,
-	5, 7, 5, 7, 11, 11, 11, 11, 6, 5, 6, 5, 1, 1, 1, 1,
-	10, 9, 6, 9, 12, 12, 13, 13, 6, 3, 6, 3, 2, 2, 3, 3,
-	5, 7, 5, 7, 11, 11, 11, 11, 6, 5, 6, 5, 1, 1, 1, 1,
-	10, 9, 6, 9, 12, 12, 12, 12, 6, 3, 6, 3, 2, 2, 2, 2,
-	5, 7, 5, 7, 11, 11, 11, 11, 6, 5, 6, 5, 1, 1, 1, 1,
-	10, 9, 6, 9, 12, 12, 12, 12, 6, 3, 6, 3, 2, 2, 2, 2,
-}
-
-// instructionSizes indicates the size of each instruction in bytes
-var instructionSizes = [256]byte{
-	2, 2, 0, 0, 2, 2, 2, 0, 1, 2, 1, 0, 3, 3, 3, 0,
-	2, 2, 0, 0, 2, 2, 2, 0, 1, 3, 1, 0, 3, 3, 3, 0,
-	3, 2, 0, 0, 2, 2, 2, 0, 1, 2, 1, 0, 3, 3, 3, 0,
-	2, 2, 0, 0, 2, 2, 2, 0, 1, 3, 1, 0, 3, 3, 3, 0,
-	1, 2, 0, 0, 2, 2, 2, 0, 1, 2, 1, 0, 3, 3, 3, 0,
-	2, 2, 0, 0, 2, 2, 2, 0, 1, 3, 1, 0, 3, 3, 3, 0,
-	1, 2, 0, 0, 2, 2, 2, 0, 1, 2, 1, 0, 3, 3, 3, 0,
-	2, 2, 0, 0, 2, 2, 2, 0, 1, 3, 1, 0, 3, 3, 3, 0,
-	2, 2, 0, 0, 2, 2, 2, 0, 1, 0, 1, 0, 3, 3, 3, 0,
-	2, 2, 0, 0, 2, 2, 2, 0, 1, 3, 1, 0, 0, 3, 0, 0,
-	2, 2, 2, 0, 2, 2, 2, 0, 1, 2, 1, 0, 3, 3, 3, 0,
-	2, 2, 0, 0, 2, 2, 2, 0, 1, 3, 1, 0, 3, 3, 3, 0,
-	2, 2, 0, 0, 2, 2, 2, 0, 1, 2, 1, 0, 3, 3, 3, 0,
-	2, 2, 0, 0, 2, 2, 2, 0, 1, 3, 1, 0, 3, 3, 3, 0,
-	2, 2, 0, 0, 2, 2, 2, 0, 1, 2, 1, 0, 3, 3, 3, 0,
-	2, 2, 0, 0, 2, 2, 2, 0, 1, 3, 1, 0, 3, 3, 3, 0,
-}
+// the opcode tables shared with the disassembler
+var (
+	instructionModes = disasm.Modes
+	instructionSizes = disasm.Sizes
+	instructionNames = disasm.Names
+)
 
 // instructionCycles indicates the number of cycles used by each instruction,
 // not including conditional cycles
@@ -135,42 +111,6 @@ var instructionPageCycles = [256]byte{
 	1, 1, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 1, 1, 0, 0,
 }
 
-// instructionNames indicates the name of each instruction
-var instructionNames = [256]string{
-	"BRK", "ORA", "KIL", "SLO", "NOP", "ORA", "ASL", "SLO",
-	"PHP", "ORA", "ASL", "ANC", "NOP", "ORA", "ASL", "SLO",
-	"BPL", "ORA", "KIL", "SLO", "NOP", "ORA", "ASL", "SLO",
-	"CLC", "ORA", "NOP", "SLO", "NOP", "ORA", "ASL", "SLO",
-	"JSR", "AND", "KIL", "RLA", "BIT", "AND", "ROL", "RLA",
-	"PLP", "AND", "ROL", "ANC", "BIT", "AND", "ROL", "RLA",
-	"BMI", "AND", "KIL", "RLA", "NOP", "AND", "ROL", "RLA",
-	"SEC", "AND", "NOP", "RLA", "NOP", "AND", "ROL", "RLA",
-	"RTI", "EOR", "KIL", "SRE", "NOP", "EOR", "LSR", "SRE",
-	"PHA", "EOR", "LSR", "ALR", "JMP", "EOR", "LSR", "SRE",
-	"BVC", "EOR", "KIL", "SRE", "NOP", "EOR", "LSR", "SRE",
-	"CLI", "EOR", "NOP", "SRE", "NOP", "EOR", "LSR", "SRE",
-	"RTS", "ADC", "KIL", "RRA", "NOP", "ADC", "ROR", "RRA",
-	"PLA", "ADC", "ROR", "ARR", "JMP", "ADC", "ROR", "RRA",
-	"BVS", "ADC", "KIL", "RRA", "NOP", "ADC", "ROR", "RRA",
-	"SEI", "ADC", "NOP", "RRA", "NOP", "ADC", "ROR", "RRA",
-	"NOP", "STA", "NOP", "SAX", "STY", "STA", "STX", "SAX",
-	"DEY", "NOP", "TXA", "XAA", "STY", "STA", "STX", "SAX",
-	"BCC", "STA", "KIL", "AHX", "STY", "STA", "STX", "SAX",
-	"TYA", "STA", "TXS", "TAS", "SHY", "STA", "SHX", "AHX",
-	"LDY", "LDA", "LDX", "LAX", "LDY", "LDA", "LDX", "LAX",
-	"TAY", "LDA", "TAX", "LAX", "LDY", "LDA", "LDX", "LAX",
-	"BCS", "LDA", "KIL", "LAX", "LDY", "LDA", "LDX", "LAX",
-	"CLV", "LDA", "TSX", "LAS", "LDY", "LDA", "LDX", "LAX",
-	"CPY", "CMP", "NOP", "DCP", "CPY", "CMP", "DEC", "DCP",
-	"INY", "CMP", "DEX", "AXS", "CPY", "CMP", "DEC", "DCP",
-	"BNE", "CMP", "KIL", "DCP", "NOP", "CMP", "DEC", "DCP",
-	"CLD", "CMP", "NOP", "DCP", "NOP", "CMP", "DEC", "DCP",
-	"CPX", "SBC", "NOP", "ISC", "CPX", "SBC", "INC", "ISC",
-	"INX", "SBC", "NOP", "SBC", "CPX", "SBC", "INC", "ISC",
-	"BEQ", "SBC", "KIL", "ISC", "NOP", "SBC", "INC", "ISC",
-	"SED", "SBC", "NOP", "ISC", "NOP", "SBC", "INC", "ISC",
-}
-
 // NewCPU create a nes cpu
 func NewCPU(cart *Cartridge) *CPU {
 	cpu := CPU{Cart: cart}
@@ -218,6 +158,9 @@ func (cpu *CPU) createTable() {
 }
 
 func (cpu *CPU) Read(address uint16) byte {
+	if cpu.debugger != nil {
+		cpu.debugger.access(address, BreakRead)
+	}
 	switch {
 	case address < 0x2000:
 		return cpu.RAM[address%0x0800]
@@ -229,13 +172,19 @@ func (cpu *CPU) Read(address uint16) byte {
 	case address == 0x4015:
 		log.Warning("Not Imp")
 	case address == 0x4016:
+		cpu.inputRead = true
 		return cpu.Joypads[0].Read()
 	case address == 0x4017:
+		cpu.inputRead = true
 		return cpu.Joypads[1].Read()
-	case address < 0x6000:
+	case address < 0x4020:
 		// TODO: I/O registers
-	case address >= 0x6000:
-		return cpu.Cart.Mapper.Read(address)
+	case address >= 0x4020:
+		value := cpu.Cart.Mapper.Read(address)
+		if patch, ok := cpu.patches[address]; ok && (!patch.hasCompare || patch.compare == value) {
+			value = patch.value
+		}
+		return value
 	default:
 		log.Fatalf("unhandled cpu memory read at address: 0x%04X", address)
 	}
@@ -243,6 +192,9 @@ func (cpu *CPU) Read(address uint16) byte {
 }
 
 func (cpu *CPU) Write(address uint16, value byte) {
+	if cpu.debugger != nil {
+		cpu.debugger.access(address, BreakWrite)
+	}
 	switch {
 	case address < 0x2000:
 		cpu.RAM[address%0x0800] = value
@@ -258,9 +210,9 @@ func (cpu *CPU) Write(address uint16, value byte) {
 		cpu.Joypads[1].Write(value)
 	case address == 0x4017:
 		log.Warning("Not Imp")
-	case address < 0x6000:
+	case address < 0x4020:
 		// TODO: I/O registers
-	case address >= 0x6000:
+	case address >= 0x4020:
 		cpu.Cart.Mapper.Write(address, value)
 	default:
 		log.Fatalf("unhandled cpu memory write at address: 0x%04X", address)
@@ -279,25 +231,22 @@ func (cpu *CPU) Read16(address uint16) uint16 {
 
 // PrintInstruction print cpu instruction
 func (cpu *CPU) PrintInstruction() {
-	opcode := cpu.Read(cpu.PC)
-	bytes := instructionSizes[opcode]
-	name := instructionNames[opcode]
-
-	w0 := fmt.Sprintf("%02X", cpu.Read(cpu.PC+0))
-	w1 := fmt.Sprintf("%02X", cpu.Read(cpu.PC+1))
-	w2 := fmt.Sprintf("%02X", cpu.Read(cpu.PC+2))
+	log.Printf("%v", disasm.Decode(cpu.Read, cpu.PC))
+}
 
-	if bytes < 2 {
-		w1 = "  "
-	}
-	if bytes < 3 {
-		w2 = "  "
+// serviceInterrupt run a pending interrupt, moving PC to its handler
+func (cpu *CPU) serviceInterrupt() {
+	if cpu.interrupt == interruptIRQ {
+		cpu.irq()
 	}
-	log.Printf("%04x %s %s %s %s", cpu.PC, w0, name, w1, w2)
+	cpu.interrupt = interruptNone
 }
 
 // Step cpu exeute a single CPU instruction
 func (cpu *CPU) Step() {
+	cpu.serviceInterrupt()
+
+	cycles := cpu.Cycles
 	opcode := cpu.Read(cpu.PC)
 	mode := instructionModes[opcode]
 
@@ -350,6 +299,10 @@ func (cpu *CPU) Step() {
 	}
 	info := &stepInfo{address, cpu.PC, mode}
 	cpu.table[opcode](info)
+
+	if mapper, ok := cpu.Cart.Mapper.(ClockedMapper); ok {
+		mapper.Clock(cpu, int(cpu.Cycles-cycles))
+	}
 }
 
 // Reset resets the CPU to its initial powerup state
@@ -368,6 +321,23 @@ func (cpu *CPU) NMI() {
 	cpu.Cycles += 7
 }
 
+// TriggerIRQ causes an IRQ interrupt to occur before the next instruction,
+// unless the interrupt disable flag is set
+func (cpu *CPU) TriggerIRQ() {
+	if cpu.I == 0 {
+		cpu.interrupt = interruptIRQ
+	}
+}
+
+// irq performs an IRQ interrupt
+func (cpu *CPU) irq() {
+	cpu.push16(cpu.PC)
+	cpu.php(nil)
+	cpu.PC = cpu.Read16(0xFFFE)
+	cpu.I = 1
+	cpu.Cycles += 7
+}
+
 // read16bug emulates a 6502 bug that caused the low byte to wrap without
 // incrementing the high byte
 func (cpu *CPU) read16bug(address uint16) uint16 {
@@ -0,0 +1,419 @@
+package nes
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// BreakKind is what a breakpoint watches for, a combination of
+// BreakExecute, BreakRead and BreakWrite
+type BreakKind byte
+
+// breakpoint kinds
+const (
+	BreakExecute BreakKind = 1 << iota
+	BreakRead
+	BreakWrite
+)
+
+// String returns the kind as letters, such as "rw"
+func (kind BreakKind) String() string {
+	var s string
+	for i, c := range "xrw" {
+		if kind&(1<<i) != 0 {
+			s += string(c)
+		}
+	}
+	return s
+}
+
+// ParseBreakKind parse letters x, r and w into a kind
+func ParseBreakKind(s string) (BreakKind, error) {
+	var kind BreakKind
+	for _, c := range strings.ToLower(s) {
+		i := strings.IndexRune("xrw", c)
+		if i < 0 {
+			return 0, fmt.Errorf("bad breakpoint kind %q, want a combination of x, r and w", s)
+		}
+		kind |= 1 << i
+	}
+	if kind == 0 {
+		return 0, fmt.Errorf("empty breakpoint kind, want a combination of x, r and w")
+	}
+	return kind, nil
+}
+
+// Breakpoint stops the CPU when it executes, reads or writes an address
+// from Address to End and its condition, if any, is true. Every such hit is
+// counted; the first Ignore ones do not stop the CPU. A tracepoint logs
+// its hits instead of stopping.
+type Breakpoint struct {
+	ID        int       `json:"id"`
+	Kind      BreakKind `json:"kind"`
+	Address   uint16    `json:"address"`
+	End       uint16    `json:"end"`
+	Enabled   bool      `json:"enabled"`
+	Condition string    `json:"condition"`
+	Trace     bool      `json:"trace"`
+	Hits      int       `json:"hits"`
+	Ignore    int       `json:"ignore"`
+	condition *Expr
+}
+
+// String describes the breakpoint, such as
+// "#2 w $0300-$03FF if A == $40, 3 hits"
+func (bp *Breakpoint) String() string {
+	s := fmt.Sprintf("#%d %s $%04X", bp.ID, bp.Kind, bp.Address)
+	if bp.Trace {
+		s = fmt.Sprintf("#%d trace %s $%04X", bp.ID, bp.Kind, bp.Address)
+	}
+	if bp.End != bp.Address {
+		s += fmt.Sprintf("-$%04X", bp.End)
+	}
+	if bp.Condition != "" {
+		s += " if " + bp.Condition
+	}
+	if bp.Hits > 0 {
+		s += fmt.Sprintf(", %d hits", bp.Hits)
+	}
+	if bp.Ignore > 0 {
+		s += fmt.Sprintf(", ignoring %d", bp.Ignore)
+	}
+	if !bp.Enabled {
+		s += " (disabled)"
+	}
+	return s
+}
+
+// SetCondition change the condition, an expression that must be non zero
+// for the breakpoint to hit. An empty one removes the condition.
+func (bp *Breakpoint) SetCondition(source string) error {
+	if strings.TrimSpace(source) == "" {
+		bp.Condition, bp.condition = "", nil
+		return nil
+	}
+	condition, err := ParseExpr(source)
+	if err != nil {
+		return err
+	}
+	bp.Condition, bp.condition = condition.Source, condition
+	return nil
+}
+
+func (bp *Breakpoint) matches(address uint16, kind BreakKind) bool {
+	return bp.Enabled && bp.Kind&kind != 0 && address >= bp.Address && address <= bp.End
+}
+
+// stepping modes
+const (
+	stepNone = iota
+	stepInto
+	stepOver
+	stepOut
+	stepRunTo
+)
+
+// Debugger stops the console on breakpoints and steps it one instruction
+// at a time. The console runs until it breaks; StepFrame returns early
+// then, and does nothing while the debugger is paused.
+type Debugger struct {
+	console     *Console
+	Breakpoints []*Breakpoint
+	nextID      int
+
+	paused bool
+	reason string
+	// resumed skips the execution breakpoints at PC when continuing from
+	// them
+	resumed bool
+	step    int
+	target  uint16 // address to run to
+	stack   byte   // SP when stepping over or out began
+
+	// instruction running, whose own bytes do not trigger read breakpoints,
+	// and the read and write breakpoints it touched. Their conditions are
+	// checked once it is done, so they see the values written.
+	running bool
+	pc      uint16
+	size    uint16
+	opcode  byte
+	touched []*Breakpoint
+
+	// trace holds the last lines logged by tracepoints, which are also
+	// written to TraceOutput when set
+	trace       []string
+	TraceOutput io.Writer
+}
+
+// traceLines is how many tracepoint lines the debugger keeps
+const traceLines = 1000
+
+// Debugger returns the debugger of the console, attaching one the first
+// time. The console runs a little slower with a debugger.
+func (console *Console) Debugger() *Debugger {
+	if console.debugger == nil {
+		console.debugger = &Debugger{console: console, nextID: 1}
+		console.CPU.debugger = console.debugger
+	}
+	return console.debugger
+}
+
+// AddBreakpoint break on an address range, end is included
+func (d *Debugger) AddBreakpoint(kind BreakKind, address, end uint16) (*Breakpoint, error) {
+	if end < address {
+		return nil, fmt.Errorf("breakpoint range $%04X-$%04X ends before it starts", address, end)
+	}
+	bp := &Breakpoint{ID: d.nextID, Kind: kind, Address: address, End: end, Enabled: true}
+	d.nextID++
+	d.Breakpoints = append(d.Breakpoints, bp)
+	return bp, nil
+}
+
+// Breakpoint returns the breakpoint with an id
+func (d *Debugger) Breakpoint(id int) (*Breakpoint, error) {
+	for _, bp := range d.Breakpoints {
+		if bp.ID == id {
+			return bp, nil
+		}
+	}
+	return nil, fmt.Errorf("no breakpoint #%d", id)
+}
+
+// RemoveBreakpoint delete the breakpoint with an id
+func (d *Debugger) RemoveBreakpoint(id int) error {
+	for i, bp := range d.Breakpoints {
+		if bp.ID == id {
+			d.Breakpoints = append(d.Breakpoints[:i], d.Breakpoints[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no breakpoint #%d", id)
+}
+
+// Paused returns whether the console is stopped, and why
+func (d *Debugger) Paused() (bool, string) {
+	return d.paused, d.reason
+}
+
+// Break stop before the next instruction
+func (d *Debugger) Break() {
+	d.pause("break")
+}
+
+// Continue run until a breakpoint
+func (d *Debugger) Continue() {
+	d.resume(stepNone)
+}
+
+// StepInto run a single instruction
+func (d *Debugger) StepInto() {
+	d.resume(stepInto)
+}
+
+// StepOver run a single instruction, or a whole subroutine for a JSR
+func (d *Debugger) StepOver() {
+	cpu := d.console.CPU
+	if d.console.Peek(cpu.PC) != 0x20 {
+		d.resume(stepInto)
+		return
+	}
+	d.resume(stepOver)
+	d.target = cpu.PC + 3
+	d.stack = cpu.SP
+}
+
+// StepOut run until the current subroutine or interrupt handler returns
+func (d *Debugger) StepOut() {
+	d.resume(stepOut)
+	d.stack = d.console.CPU.SP
+}
+
+// RunTo run until the CPU gets to an address, or a breakpoint
+func (d *Debugger) RunTo(address uint16) {
+	d.resume(stepRunTo)
+	d.target = address
+}
+
+func (d *Debugger) pause(reason string) {
+	d.paused = true
+	d.reason = reason
+	d.step = stepNone
+}
+
+func (d *Debugger) resume(step int) {
+	d.paused = false
+	d.reason = ""
+	d.resumed = true
+	d.step = step
+}
+
+// breakBefore returns whether to stop before the next instruction
+func (d *Debugger) breakBefore() bool {
+	if d.paused {
+		return true
+	}
+	cpu := d.console.CPU
+	if !d.resumed {
+		if d.step == stepRunTo && cpu.PC == d.target {
+			d.pause(fmt.Sprintf("reached $%04X", d.target))
+			return true
+		}
+		for _, bp := range d.Breakpoints {
+			if bp.matches(cpu.PC, BreakExecute) && d.hits(bp, cpu.PC) {
+				d.pause(fmt.Sprintf("breakpoint %v", bp))
+				return true
+			}
+		}
+	}
+	d.resumed = false
+	d.running = true
+	d.pc = cpu.PC
+	d.opcode = d.console.Peek(cpu.PC)
+	d.size = uint16(instructionSizes[d.opcode])
+	return false
+}
+
+// breakAfter returns whether to stop after the instruction just run
+func (d *Debugger) breakAfter() bool {
+	d.running = false
+	cpu := d.console.CPU
+	var hit *Breakpoint
+	for _, bp := range d.touched {
+		if d.hits(bp, d.pc) && hit == nil {
+			hit = bp
+		}
+	}
+	d.touched = d.touched[:0]
+	switch {
+	case hit != nil:
+		d.pause(fmt.Sprintf("breakpoint %v", hit))
+	case d.step == stepInto:
+		d.pause("step")
+	case d.step == stepOver && cpu.PC == d.target && cpu.SP == d.stack:
+		d.pause("step")
+	case d.step == stepOut && (d.opcode == 0x60 || d.opcode == 0x40) && cpu.SP > d.stack:
+		d.pause("step out")
+	}
+	return d.paused
+}
+
+// access note a memory read or write by the running instruction
+func (d *Debugger) access(address uint16, kind BreakKind) {
+	if !d.running || (kind == BreakRead && address-d.pc < d.size) {
+		return
+	}
+next:
+	for _, bp := range d.Breakpoints {
+		if !bp.matches(address, kind) {
+			continue
+		}
+		for _, touched := range d.touched {
+			if touched == bp {
+				continue next
+			}
+		}
+		d.touched = append(d.touched, bp)
+	}
+}
+
+// hits check the condition of a breakpoint that matched the instruction at
+// pc, count the hit and returns whether to stop. Tracepoints log the hit
+// and never stop.
+func (d *Debugger) hits(bp *Breakpoint, pc uint16) bool {
+	if bp.condition != nil && bp.condition.Eval(d.console) == 0 {
+		return false
+	}
+	bp.Hits++
+	if bp.Trace {
+		line := fmt.Sprintf("#%d frame %d  %-30v %s", bp.ID, d.console.Frame, d.console.Disassemble(pc), d.Registers())
+		if len(d.trace) == traceLines {
+			d.trace = append(d.trace[:0], d.trace[1:]...)
+		}
+		d.trace = append(d.trace, line)
+		if d.TraceOutput != nil {
+			fmt.Fprintln(d.TraceOutput, line)
+		}
+		return false
+	}
+	if bp.Ignore > 0 {
+		bp.Ignore--
+		return false
+	}
+	return true
+}
+
+// Trace returns the last lines logged by tracepoints, oldest first
+func (d *Debugger) Trace() []string {
+	return d.trace
+}
+
+// registers are the names SetRegister accepts
+var registers = []string{"A", "X", "Y", "SP", "PC", "P", "C", "Z", "I", "D", "V", "N"}
+
+// SetRegister change a register: A, X, Y, SP, PC, P for the status byte or
+// a single flag C, Z, I, D, V or N
+func (d *Debugger) SetRegister(name string, v uint16) error {
+	name = strings.ToUpper(name)
+	known := false
+	for _, r := range registers {
+		known = known || r == name
+	}
+	if !known {
+		return fmt.Errorf("unknown register %q, want one of %s", name, strings.Join(registers, ", "))
+	}
+	cpu := d.console.CPU
+	switch name {
+	case "PC":
+		cpu.PC = v
+		return nil
+	case "C", "Z", "I", "D", "V", "N":
+		if v > 1 {
+			return fmt.Errorf("flag %s is 0 or 1", name)
+		}
+	default:
+		if v > 0xFF {
+			return fmt.Errorf("register %s is 8 bit, $%X is too large", name, v)
+		}
+	}
+	b := byte(v)
+	switch name {
+	case "A":
+		cpu.A = b
+	case "X":
+		cpu.X = b
+	case "Y":
+		cpu.Y = b
+	case "SP":
+		cpu.SP = b
+	case "P":
+		cpu.SetFlags(b)
+	case "C":
+		cpu.C = b
+	case "Z":
+		cpu.Z = b
+	case "I":
+		cpu.I = b
+	case "D":
+		cpu.D = b
+	case "V":
+		cpu.V = b
+	case "N":
+		cpu.N = b
+	}
+	return nil
+}
+
+// Registers returns the CPU registers, such as
+// "PC:C000 A:00 X:00 Y:00 P:24 SP:FD nvUbdIzc"
+func (d *Debugger) Registers() string {
+	cpu := d.console.CPU
+	flags := []byte("nvubdizc")
+	for i := range flags {
+		if cpu.Flags()&(0x80>>i) != 0 {
+			flags[i] -= 'a' - 'A'
+		}
+	}
+	return fmt.Sprintf("PC:%04X A:%02X X:%02X Y:%02X P:%02X SP:%02X %s",
+		cpu.PC, cpu.A, cpu.X, cpu.Y, cpu.Flags(), cpu.SP, flags)
+}
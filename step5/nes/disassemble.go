@@ -0,0 +1,40 @@
+package nes
+
+import "github.com/shadow1163/nes-go/step5/disasm"
+
+// Disassemble decode the instruction at an address. Memory is read with
+// Peek so disassembling has no side effects.
+func (console *Console) Disassemble(address uint16) disasm.Instruction {
+	return disasm.Decode(console.Peek, address)
+}
+
+// DisassembleAround decode about before instructions ahead of an address,
+// the one at it and after ones following it. Code cannot be decoded
+// backwards reliably, so it starts far enough back to land on the address.
+func (console *Console) DisassembleAround(address uint16, before, after int) []disasm.Instruction {
+	var lines []disasm.Instruction
+	for back := uint16(3 * before); back > 0; back-- {
+		start := address - back
+		var decoded []disasm.Instruction
+		pc := start
+		for pc-start < back {
+			i := console.Disassemble(pc)
+			decoded = append(decoded, i)
+			pc += uint16(len(i.Bytes))
+		}
+		if pc == address {
+			lines = decoded
+			break
+		}
+	}
+	if len(lines) > before {
+		lines = lines[len(lines)-before:]
+	}
+	pc := address
+	for n := 0; n <= after; n++ {
+		i := console.Disassemble(pc)
+		lines = append(lines, i)
+		pc += uint16(len(i.Bytes))
+	}
+	return lines
+}
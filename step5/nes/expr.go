@@ -0,0 +1,304 @@
+package nes
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Expr is a compiled debugger expression, such as
+//
+//	A == $40 && [$0300] > 3 && frame > 60
+//
+// Values are integers. Names are the registers A, X, Y, SP, PC and P, the
+// flags C, Z, I, D, V and N, and frame. The PPU position (scanline and
+// cycle) is not emulated, as frames run a fixed number of instructions, so
+// naming it is an error.
+// [ADDRESS] reads a byte of memory and {ADDRESS} a little endian word,
+// without side effects. Numbers are decimal, or hex with a $ or 0x prefix.
+// The operators are those of C: unary - ! ~, * / %, + -, << >>,
+// < <= > >=, == !=, &, ^, |, && and ||, which return 1 for true and 0 for
+// false. Dividing by zero gives 0.
+type Expr struct {
+	Source string
+	eval   func(console *Console) int
+}
+
+// Eval compute the expression for the current state of a console
+func (e *Expr) Eval(console *Console) int {
+	return e.eval(console)
+}
+
+// String returns the expression source
+func (e *Expr) String() string {
+	return e.Source
+}
+
+// exprNames are the values an expression can name, lower case
+var exprNames = map[string]func(console *Console) int{
+	"a":     func(c *Console) int { return int(c.CPU.A) },
+	"x":     func(c *Console) int { return int(c.CPU.X) },
+	"y":     func(c *Console) int { return int(c.CPU.Y) },
+	"sp":    func(c *Console) int { return int(c.CPU.SP) },
+	"pc":    func(c *Console) int { return int(c.CPU.PC) },
+	"p":     func(c *Console) int { return int(c.CPU.Flags()) },
+	"c":     func(c *Console) int { return int(c.CPU.C) },
+	"z":     func(c *Console) int { return int(c.CPU.Z) },
+	"i":     func(c *Console) int { return int(c.CPU.I) },
+	"d":     func(c *Console) int { return int(c.CPU.D) },
+	"v":     func(c *Console) int { return int(c.CPU.V) },
+	"n":     func(c *Console) int { return int(c.CPU.N) },
+	"frame": func(c *Console) int { return c.Frame },
+}
+
+// exprUnemulated are names an expression could be expected to know, but
+// whose value the console does not emulate
+var exprUnemulated = map[string]bool{"scanline": true, "cycle": true}
+
+// exprBinary are the binary operators by precedence, loosest first
+var exprBinary = [][]string{
+	{"||"},
+	{"&&"},
+	{"|"},
+	{"^"},
+	{"&"},
+	{"==", "!="},
+	{"<=", ">=", "<", ">"},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+// exprTokens are the operators and brackets, two character ones first
+var exprTokens = []string{
+	"||", "&&", "==", "!=", "<=", ">=", "<<", ">>",
+	"|", "^", "&", "<", ">", "+", "-", "*", "/", "%", "!", "~",
+	"(", ")", "[", "]", "{", "}",
+}
+
+func truth(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// applyOperator apply a binary operator
+func applyOperator(op string, a, b int) int {
+	switch op {
+	case "||":
+		return truth(a != 0 || b != 0)
+	case "&&":
+		return truth(a != 0 && b != 0)
+	case "|":
+		return a | b
+	case "^":
+		return a ^ b
+	case "&":
+		return a & b
+	case "==":
+		return truth(a == b)
+	case "!=":
+		return truth(a != b)
+	case "<=":
+		return truth(a <= b)
+	case ">=":
+		return truth(a >= b)
+	case "<":
+		return truth(a < b)
+	case ">":
+		return truth(a > b)
+	case "<<":
+		return a << uint(b&63)
+	case ">>":
+		return a >> uint(b&63)
+	case "+":
+		return a + b
+	case "-":
+		return a - b
+	case "*":
+		return a * b
+	case "/":
+		if b == 0 {
+			return 0
+		}
+		return a / b
+	case "%":
+		if b == 0 {
+			return 0
+		}
+		return a % b
+	}
+	return 0
+}
+
+// exprParser is a precedence climbing parser over the tokens of an
+// expression
+type exprParser struct {
+	source string
+	tokens []string
+	pos    int
+}
+
+// ParseExpr compile an expression
+func ParseExpr(source string) (*Expr, error) {
+	p := &exprParser{source: source}
+	if err := p.tokenize(); err != nil {
+		return nil, err
+	}
+	eval, err := p.parse(0)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, p.errorf("unexpected %q", p.tokens[p.pos])
+	}
+	return &Expr{Source: strings.TrimSpace(source), eval: eval}, nil
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("expression %q: %s", p.source, fmt.Sprintf(format, args...))
+}
+
+func (p *exprParser) tokenize() error {
+	s := p.source
+	for len(s) > 0 {
+		c := s[0]
+		switch {
+		case c == ' ' || c == '\t':
+			s = s[1:]
+			continue
+		case c == '$' || c >= '0' && c <= '9' || c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			n := 1
+			for n < len(s) && (s[n] >= '0' && s[n] <= '9' || s[n] == '_' || s[n] >= 'a' && s[n] <= 'z' || s[n] >= 'A' && s[n] <= 'Z') {
+				n++
+			}
+			p.tokens = append(p.tokens, s[:n])
+			s = s[n:]
+			continue
+		}
+		found := false
+		for _, t := range exprTokens {
+			if strings.HasPrefix(s, t) {
+				p.tokens = append(p.tokens, t)
+				s = s[len(t):]
+				found = true
+				break
+			}
+		}
+		if !found {
+			return p.errorf("unexpected %q", s[:1])
+		}
+	}
+	if len(p.tokens) == 0 {
+		return p.errorf("empty")
+	}
+	return nil
+}
+
+func (p *exprParser) next() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	return p.tokens[p.pos]
+}
+
+// parse a binary expression whose operators bind at least as tight as
+// level
+func (p *exprParser) parse(level int) (func(*Console) int, error) {
+	if level == len(exprBinary) {
+		return p.unary()
+	}
+	left, err := p.parse(level + 1)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		op := p.next()
+		known := false
+		for _, o := range exprBinary[level] {
+			known = known || o == op
+		}
+		if !known {
+			return left, nil
+		}
+		p.pos++
+		right, err := p.parse(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(c *Console) int { return applyOperator(op, l(c), right(c)) }
+	}
+}
+
+func (p *exprParser) unary() (func(*Console) int, error) {
+	switch op := p.next(); op {
+	case "-", "!", "~":
+		p.pos++
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		switch op {
+		case "-":
+			return func(c *Console) int { return -operand(c) }, nil
+		case "!":
+			return func(c *Console) int { return truth(operand(c) == 0) }, nil
+		}
+		return func(c *Console) int { return ^operand(c) }, nil
+	}
+	return p.primary()
+}
+
+func (p *exprParser) primary() (func(*Console) int, error) {
+	token := p.next()
+	p.pos++
+	switch token {
+	case "":
+		return nil, p.errorf("unexpected end")
+	case "(", "[", "{":
+		inner, err := p.parse(0)
+		if err != nil {
+			return nil, err
+		}
+		closing := map[string]string{"(": ")", "[": "]", "{": "}"}[token]
+		if p.next() != closing {
+			return nil, p.errorf("missing %q", closing)
+		}
+		p.pos++
+		switch token {
+		case "[":
+			return func(c *Console) int { return int(c.Peek(uint16(inner(c)))) }, nil
+		case "{":
+			return func(c *Console) int {
+				address := uint16(inner(c))
+				return int(c.Peek(address)) | int(c.Peek(address+1))<<8
+			}, nil
+		}
+		return inner, nil
+	}
+	if name, ok := exprNames[strings.ToLower(token)]; ok {
+		return name, nil
+	}
+	if exprUnemulated[strings.ToLower(token)] {
+		return nil, p.errorf("%s is not emulated", token)
+	}
+	var value uint64
+	var err error
+	switch {
+	case strings.HasPrefix(token, "$"):
+		value, err = strconv.ParseUint(token[1:], 16, 32)
+	case token[0] >= '0' && token[0] <= '9':
+		value, err = strconv.ParseUint(token, 0, 32)
+	case token[0] == '_' || token[0] >= 'a' && token[0] <= 'z' || token[0] >= 'A' && token[0] <= 'Z':
+		return nil, p.errorf("unknown name %q", token)
+	default:
+		return nil, p.errorf("unexpected %q", token)
+	}
+	if err != nil {
+		return nil, p.errorf("bad number %q", token)
+	}
+	n := int(value)
+	return func(*Console) int { return n }, nil
+}
@@ -0,0 +1,100 @@
+package nes
+
+import (
+	"strings"
+	"testing"
+)
+
+func newTestConsole(t *testing.T) *Console {
+	cart := NewCartridge(2, 1, 1)
+	mapper, err := NewMapper(0, cart)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cart.Mapper = mapper
+	return NewConsole(cart)
+}
+
+func TestExprEval(t *testing.T) {
+	console := newTestConsole(t)
+	console.CPU.A = 0x40
+	console.CPU.X = 3
+	console.CPU.C = 1
+	console.CPU.RAM[0x0300] = 5
+	console.CPU.RAM[0x0010] = 0x34
+	console.CPU.RAM[0x0011] = 0x12
+	console.Frame = 100
+
+	tests := []struct {
+		source string
+		want   int
+	}{
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"10 - 4 - 3", 3},
+		{"100 / 10 / 5", 2},
+		{"7 % 4", 3},
+		{"1 << 2 + 1", 8},
+		{"1 + 2 == 3", 1},
+		{"1 < 2 == 1", 1},
+		{"6 & 3 == 2", 0},
+		{"1 | 2 ^ 3 & 1", 3},
+		{"0 || 1 && 0", 0},
+		{"1 || 0 && 0", 1},
+		{"-2 * 3", -6},
+		{"!0 + !5", 1},
+		{"~0", -1},
+		{"- -4", 4},
+		{"$10 + 0x10 + 16", 48},
+		{"5 / 0", 0},
+		{"5 % 0", 0},
+		{"A == $40 && [$0300] > 3 && frame > 60", 1},
+		{"a + x + c", 0x44},
+		{"{$10}", 0x1234},
+		{"[$10 + 1]", 0x12},
+		{"[$0800 + $0300]", 5}, // RAM mirror
+		{"frame", 100},
+	}
+	for _, test := range tests {
+		expr, err := ParseExpr(test.source)
+		if err != nil {
+			t.Errorf("ParseExpr(%q): %v", test.source, err)
+			continue
+		}
+		if got := expr.Eval(console); got != test.want {
+			t.Errorf("%q = %d, want %d", test.source, got, test.want)
+		}
+	}
+}
+
+func TestExprErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		err    string
+	}{
+		{"", "empty"},
+		{"   ", "empty"},
+		{"1 +", "unexpected end"},
+		{"(1 + 2", `missing ")"`},
+		{"[$10", `missing "]"`},
+		{"{$10", `missing "}"`},
+		{"1 2", `unexpected "2"`},
+		{"1 + )", `unexpected ")"`},
+		{"1 @ 2", `unexpected "@"`},
+		{"foo", `unknown name "foo"`},
+		{"$zz", `bad number "$zz"`},
+		{"09", `bad number "09"`},
+		{"scanline < 240", "scanline is not emulated"},
+		{"CYCLE", "CYCLE is not emulated"},
+	}
+	for _, test := range tests {
+		_, err := ParseExpr(test.source)
+		if err == nil {
+			t.Errorf("ParseExpr(%q) succeeded, want %q", test.source, test.err)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("ParseExpr(%q) = %q, want %q", test.source, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,542 @@
+package nes
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+)
+
+const (
+	fdsSideSize = 65500
+	// CPU cycles between two bytes passing under the disk head (~96.4 kbit/s)
+	fdsByteCycles = 149
+	// CPU cycles for the head to return to the start of the disk
+	fdsRewindCycles = 50000
+	// CPU cycles a disk stays out of the drive when switching sides, long
+	// enough for the BIOS to notice it was ejected
+	fdsInsertDelay = 1789773
+)
+
+// FDSBIOS is the 8KB disksys.rom image needed to run Famicom Disk System
+// games. It has to be provided by the user, see LoadFDSBIOS.
+var FDSBIOS []byte
+
+// LoadFDSBIOS read the disksys.rom BIOS image
+func LoadFDSBIOS(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	if len(data) != 8192 {
+		return fmt.Errorf("%s: FDS BIOS must be 8192 bytes, got %d", filename, len(data))
+	}
+	FDSBIOS = data
+	return nil
+}
+
+// isFDSImage reports whether data is a .fds disk image, with or without
+// the fwNES header
+func isFDSImage(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("FDS\x1a")) ||
+		bytes.HasPrefix(data, []byte("\x01*NINTENDO-HVC*"))
+}
+
+// FDS implements the Famicom Disk System RAM adapter: 32KB PRG-RAM at
+// $6000-$DFFF, the BIOS at $E000, 8KB CHR-RAM, the timer IRQ, the disk
+// drive registers and the expansion sound channel.
+//
+// http://wiki.nesdev.com/w/index.php/Family_Computer_Disk_System
+type FDS struct {
+	*Cartridge
+	bios  []byte
+	sides [][]byte // raw disk sides, with gaps and CRCs as the drive sees them
+	audio fdsAudio
+
+	// $4023
+	diskRegEnabled  bool
+	soundRegEnabled bool
+
+	// Timer IRQ, $4020-$4022.
+	irqReload  uint16
+	irqCounter uint16
+	irqRepeat  bool
+	irqEnabled bool
+	timerIRQ   bool
+
+	// Drive state.
+	side         int // inserted side, -1 if none
+	nextSide     int // side to insert once insertDelay runs out
+	insertDelay  int
+	position     int
+	delay        int
+	motorOn      bool
+	resetXfer    bool
+	readMode     bool
+	crcControl   bool
+	prevCRC      bool
+	diskReady    bool
+	diskIRQOn    bool
+	diskIRQ      bool
+	endOfHead    bool
+	scanning     bool
+	gapEnded     bool
+	xferComplete bool
+	readData     byte
+	writeData    byte
+	crc          uint16
+	extOutput    byte
+}
+
+// LoadFDS build a cartridge for a .fds disk image. FDSBIOS must be set.
+func LoadFDS(data []byte) (*Cartridge, error) {
+	if FDSBIOS == nil {
+		return nil, errors.New("FDS image needs the disksys.rom BIOS")
+	}
+	if bytes.HasPrefix(data, []byte("FDS\x1a")) {
+		data = data[16:]
+	}
+	if len(data) < fdsSideSize {
+		return nil, errors.New("FDS image is truncated")
+	}
+
+	// 4 x 8KB PRG-RAM banks for $6000-$DFFF and 8KB of CHR-RAM.
+	cart := NewCartridge(0, 0, 4)
+	cart.Mirror = horizontal
+	cart.MapperID = -1
+	cart.Title = "FDS"
+	cart.CRC32, cart.SHA1 = hashBytes(data)
+
+	m := &FDS{Cartridge: cart, bios: FDSBIOS, side: -1, nextSide: 0, insertDelay: fdsInsertDelay}
+	for len(data) >= fdsSideSize {
+		m.sides = append(m.sides, fdsRawSide(data[:fdsSideSize]))
+		data = data[fdsSideSize:]
+	}
+	m.endOfHead = true
+	m.audio.reset()
+	cart.Mapper = m
+	log.Printf("FDS: %d disk sides", len(m.sides))
+	return cart, nil
+}
+
+// fdsRawSide convert one side of a .fds image into the byte stream read by
+// the drive: a leading gap, and each block prefixed with the gap end marker
+// and followed by its CRC and an inter-block gap.
+func fdsRawSide(side []byte) []byte {
+	raw := make([]byte, 28300/8, fdsSideSize+8192)
+	for i := 0; i < len(side); {
+		var length int
+		switch side[i] {
+		case 1: // disk info
+			length = 56
+		case 2: // file amount
+			length = 2
+		case 3: // file header
+			length = 16
+		case 4: // file data, size comes from the preceding file header
+			if i < 3 {
+				return fdsPadSide(raw)
+			}
+			length = 1 + (int(side[i-3]) | int(side[i-2])<<8)
+		default:
+			return fdsPadSide(raw)
+		}
+		if i+length > len(side) {
+			length = len(side) - i
+		}
+		block := side[i : i+length]
+		raw = append(raw, 0x80)
+		raw = append(raw, block...)
+		crc := fdsBlockCRC(block)
+		raw = append(raw, byte(crc), byte(crc>>8))
+		raw = append(raw, make([]byte, 976/8)...)
+		i += length
+	}
+	return fdsPadSide(raw)
+}
+
+// fdsPadSide fill the rest of a raw side with gap so files can be appended
+func fdsPadSide(raw []byte) []byte {
+	if len(raw) < fdsSideSize {
+		raw = append(raw, make([]byte, fdsSideSize-len(raw))...)
+	}
+	return raw
+}
+
+// fdsCRC feed one byte into the FDS CRC-16 (polynomial 0x8408)
+func fdsCRC(crc uint16, value byte) uint16 {
+	for n := uint(0); n < 8; n++ {
+		carry := crc & 1
+		crc >>= 1
+		if carry != 0 {
+			crc ^= 0x8408
+		}
+		if value&(1<<n) != 0 {
+			crc ^= 0x8000
+		}
+	}
+	return crc
+}
+
+// fdsBlockCRC compute the CRC stored after a block, which also covers the
+// gap end marker
+func fdsBlockCRC(block []byte) uint16 {
+	crc := fdsCRC(0, 0x80)
+	for _, b := range block {
+		crc = fdsCRC(crc, b)
+	}
+	crc = fdsCRC(crc, 0)
+	return fdsCRC(crc, 0)
+}
+
+// NumSides returns the number of disk sides in the image
+func (m *FDS) NumSides() int {
+	return len(m.sides)
+}
+
+// Side returns the inserted disk side, -1 if the drive is empty
+func (m *FDS) Side() int {
+	return m.side
+}
+
+// EjectDisk remove the disk from the drive
+func (m *FDS) EjectDisk() {
+	m.side = -1
+	m.nextSide = -1
+	m.insertDelay = 0
+}
+
+// InsertDisk eject the current disk and insert the given side after a
+// delay, like a player swapping disks
+func (m *FDS) InsertDisk(side int) error {
+	if side < 0 || side >= len(m.sides) {
+		return fmt.Errorf("FDS image has no disk side %d", side)
+	}
+	m.side = -1
+	m.nextSide = side
+	m.insertDelay = fdsInsertDelay
+	return nil
+}
+
+// NextSide insert the next disk side, wrapping around to the first
+func (m *FDS) NextSide() error {
+	side := m.side
+	if side < 0 {
+		side = m.nextSide
+	}
+	return m.InsertDisk((side + 1) % len(m.sides))
+}
+
+func (m *FDS) Read(address uint16) byte {
+	switch {
+	case address < 0x2000:
+		return m.CHR[0][address]
+	case address >= 0xE000:
+		return m.bios[address-0xE000]
+	case address >= 0x6000:
+		offset := int(address - 0x6000)
+		return m.SRAM[offset/8192][offset%8192]
+	case address >= 0x4040 && address < 0x4098:
+		if m.soundRegEnabled {
+			return m.audio.read(address)
+		}
+	case address >= 0x4030 && address < 0x4040:
+		if m.diskRegEnabled {
+			return m.readRegister(address)
+		}
+	}
+	return 0
+}
+
+func (m *FDS) Write(address uint16, value byte) {
+	switch {
+	case address < 0x2000:
+		m.CHR[0][address] = value
+	case address >= 0xE000:
+		log.Warning(fmt.Sprintf("try to write FDS BIOS address %x", address))
+	case address >= 0x6000:
+		offset := int(address - 0x6000)
+		m.SRAM[offset/8192][offset%8192] = value
+	case address >= 0x4040 && address < 0x4098:
+		if m.soundRegEnabled {
+			m.audio.write(address, value)
+		}
+	case address == 0x4023:
+		m.diskRegEnabled = value&0x01 != 0
+		m.soundRegEnabled = value&0x02 != 0
+		if !m.diskRegEnabled {
+			m.irqEnabled = false
+			m.timerIRQ = false
+			m.diskIRQ = false
+		}
+	case address >= 0x4020 && address < 0x4027:
+		if m.diskRegEnabled {
+			m.writeRegister(address, value)
+		}
+	}
+}
+
+func (m *FDS) readRegister(address uint16) byte {
+	var value byte
+	switch address {
+	case 0x4030:
+		if m.timerIRQ {
+			value |= 0x01
+		}
+		if m.xferComplete {
+			value |= 0x02
+		}
+		if m.endOfHead {
+			value |= 0x40
+		}
+		m.xferComplete = false
+		m.timerIRQ = false
+		m.diskIRQ = false
+	case 0x4031:
+		value = m.readData
+		m.xferComplete = false
+		m.diskIRQ = false
+	case 0x4032:
+		if m.side < 0 {
+			value |= 0x01 | 0x04 // no disk, not writable
+		}
+		if m.side < 0 || !m.scanning {
+			value |= 0x02 // not ready
+		}
+	case 0x4033:
+		value = 0x80 // battery good
+	}
+	return value
+}
+
+func (m *FDS) writeRegister(address uint16, value byte) {
+	switch address {
+	case 0x4020:
+		m.irqReload = m.irqReload&0xFF00 | uint16(value)
+	case 0x4021:
+		m.irqReload = m.irqReload&0x00FF | uint16(value)<<8
+	case 0x4022:
+		m.irqRepeat = value&0x01 != 0
+		m.irqEnabled = value&0x02 != 0
+		if m.irqEnabled {
+			m.irqCounter = m.irqReload
+		} else {
+			m.timerIRQ = false
+		}
+	case 0x4024:
+		m.writeData = value
+		m.xferComplete = false
+		m.diskIRQ = false
+	case 0x4025:
+		m.motorOn = value&0x01 != 0
+		m.resetXfer = value&0x02 != 0
+		m.readMode = value&0x04 != 0
+		if value&0x08 != 0 {
+			m.Mirror = horizontal
+		} else {
+			m.Mirror = vertical
+		}
+		m.crcControl = value&0x10 != 0
+		m.diskReady = value&0x40 != 0
+		m.diskIRQOn = value&0x80 != 0
+		m.diskIRQ = false
+	case 0x4026:
+		m.extOutput = value
+	}
+}
+
+// Clock advance the timer, the drive and the sound channel
+func (m *FDS) Clock(cpu *CPU, cycles int) {
+	for i := 0; i < cycles; i++ {
+		m.clockTimer()
+		m.clockDrive()
+		if m.soundRegEnabled {
+			m.audio.clock()
+		}
+	}
+	if m.timerIRQ || m.diskIRQ {
+		cpu.TriggerIRQ()
+	}
+}
+
+// AudioOutput returns the expansion sound level in [0, 1]
+func (m *FDS) AudioOutput() float32 {
+	return m.audio.output()
+}
+
+func (m *FDS) clockTimer() {
+	if !m.irqEnabled || !m.diskRegEnabled {
+		return
+	}
+	if m.irqCounter == 0 {
+		m.timerIRQ = true
+		m.irqCounter = m.irqReload
+		if !m.irqRepeat {
+			m.irqEnabled = false
+		}
+	} else {
+		m.irqCounter--
+	}
+}
+
+func (m *FDS) clockDrive() {
+	if m.insertDelay > 0 {
+		m.insertDelay--
+		if m.insertDelay == 0 && m.nextSide >= 0 {
+			m.side = m.nextSide
+			log.Debug(fmt.Sprintf("FDS: disk side %d inserted", m.side))
+		}
+	}
+	if m.side < 0 || !m.motorOn {
+		m.endOfHead = true
+		m.scanning = false
+		return
+	}
+	if m.resetXfer && !m.scanning {
+		return
+	}
+	if m.endOfHead {
+		m.delay = fdsRewindCycles
+		m.endOfHead = false
+		m.position = 0
+		m.gapEnded = false
+		return
+	}
+	if m.delay > 0 {
+		m.delay--
+		return
+	}
+
+	m.scanning = true
+	disk := m.sides[m.side]
+	needIRQ := m.diskIRQOn
+	if m.readMode {
+		var data byte
+		if m.position < len(disk) {
+			data = disk[m.position]
+		}
+		if !m.prevCRC {
+			m.crc = fdsCRC(m.crc, data)
+		}
+		if !m.diskReady {
+			m.gapEnded = false
+			m.crc = 0
+		} else if data != 0 && !m.gapEnded {
+			// The gap end marker itself is not transferred.
+			m.gapEnded = true
+			needIRQ = false
+		}
+		if m.gapEnded {
+			m.xferComplete = true
+			m.readData = data
+			if needIRQ {
+				m.diskIRQ = true
+			}
+		}
+	} else {
+		var data byte
+		if !m.crcControl {
+			m.xferComplete = true
+			data = m.writeData
+			if needIRQ {
+				m.diskIRQ = true
+			}
+		}
+		if !m.diskReady {
+			data = 0
+		}
+		if !m.crcControl {
+			m.crc = fdsCRC(m.crc, data)
+		} else {
+			if !m.prevCRC {
+				m.crc = fdsCRC(m.crc, 0)
+				m.crc = fdsCRC(m.crc, 0)
+			}
+			data = byte(m.crc)
+			m.crc >>= 8
+		}
+		if m.position < len(disk) {
+			disk[m.position] = data
+		}
+		m.gapEnded = false
+	}
+	m.prevCRC = m.crcControl
+
+	m.position++
+	if m.position >= len(disk) {
+		m.motorOn = false
+		m.endOfHead = true
+	} else {
+		m.delay = fdsByteCycles
+	}
+}
+
+// stateSections save the timer, the drive with the disks, which games
+// write to, and the sound channel
+func (m *FDS) stateSections() []stateSection {
+	return []stateSection{
+		{"FDS ", func(e *stateEncoder) {
+			e.bool(m.diskRegEnabled)
+			e.bool(m.soundRegEnabled)
+			e.uint16(m.irqReload)
+			e.uint16(m.irqCounter)
+			for _, flag := range m.stateFlags() {
+				e.bool(*flag)
+			}
+			e.int(m.side)
+			e.int(m.nextSide)
+			e.int(m.insertDelay)
+			e.int(m.position)
+			e.int(m.delay)
+			e.byte(m.readData)
+			e.byte(m.writeData)
+			e.uint16(m.crc)
+			e.byte(m.extOutput)
+			for _, side := range m.sides {
+				e.bytes(side)
+			}
+		}, func(d *stateDecoder) {
+			m.diskRegEnabled = d.bool()
+			m.soundRegEnabled = d.bool()
+			m.irqReload = d.uint16()
+			m.irqCounter = d.uint16()
+			for _, flag := range m.stateFlags() {
+				*flag = d.bool()
+			}
+			m.side = d.int()
+			m.nextSide = d.int()
+			m.insertDelay = d.int()
+			m.position = d.int()
+			m.delay = d.int()
+			m.readData = d.byte()
+			m.writeData = d.byte()
+			m.crc = d.uint16()
+			m.extOutput = d.byte()
+			for _, side := range m.sides {
+				d.bytes(side)
+			}
+			if d.err != nil {
+				return
+			}
+			switch {
+			case m.side < -1 || m.side >= len(m.sides):
+				d.err = fmt.Errorf("save state has disk side %d of %d", m.side, len(m.sides))
+			case m.nextSide < -1 || m.nextSide >= len(m.sides):
+				d.err = fmt.Errorf("save state has disk side %d of %d", m.nextSide, len(m.sides))
+			case m.position < 0:
+				d.err = fmt.Errorf("save state has disk position %d", m.position)
+			}
+		}},
+		{"FDSA", m.audio.saveState, m.audio.loadState},
+	}
+}
+
+// stateFlags returns the timer and drive flags in save state order
+func (m *FDS) stateFlags() []*bool {
+	return []*bool{
+		&m.irqRepeat, &m.irqEnabled, &m.timerIRQ,
+		&m.motorOn, &m.resetXfer, &m.readMode, &m.crcControl, &m.prevCRC,
+		&m.diskReady, &m.diskIRQOn, &m.diskIRQ, &m.endOfHead, &m.scanning,
+		&m.gapEnded, &m.xferComplete,
+	}
+}
@@ -0,0 +1,294 @@
+package nes
+
+import "fmt"
+
+// fdsEnvelope is one of the two FDS sound envelope units
+type fdsEnvelope struct {
+	speed    byte
+	gain     byte
+	increase bool
+	off      bool
+	timer    int
+}
+
+// write handle $4080 / $4084
+func (e *fdsEnvelope) write(value byte, masterSpeed byte) {
+	e.off = value&0x80 != 0
+	e.increase = value&0x40 != 0
+	e.speed = value & 0x3F
+	if e.off {
+		e.gain = value & 0x3F
+	}
+	e.resetTimer(masterSpeed)
+}
+
+func (e *fdsEnvelope) resetTimer(masterSpeed byte) {
+	e.timer = 8 * (int(e.speed) + 1) * int(masterSpeed)
+}
+
+// clock returns true when the gain changed
+func (e *fdsEnvelope) clock(masterSpeed byte) bool {
+	if e.off || masterSpeed == 0 {
+		return false
+	}
+	e.timer--
+	if e.timer > 0 {
+		return false
+	}
+	e.resetTimer(masterSpeed)
+	if e.increase && e.gain < 32 {
+		e.gain++
+	} else if !e.increase && e.gain > 0 {
+		e.gain--
+	}
+	return true
+}
+
+// fdsModAdjust is how each mod table entry changes the mod counter, 4 resets it
+var fdsModAdjust = [8]int{0, 1, 2, 4, 0, -4, -2, -1}
+
+// fdsMasterVolume scales the output by 2/2, 2/3, 2/4 and 2/5
+var fdsMasterVolume = [4]float32{1, 2.0 / 3, 2.0 / 4, 2.0 / 5}
+
+// fdsAudio is the FDS wavetable sound channel with its frequency modulator
+//
+// http://wiki.nesdev.com/w/index.php/FDS_audio
+type fdsAudio struct {
+	wave         [64]byte
+	waveWrite    bool
+	masterVolume byte
+	masterSpeed  byte
+
+	volume       fdsEnvelope
+	frequency    uint16
+	haltWave     bool
+	haltEnvelope bool
+	waveAcc      uint32
+	wavePos      byte
+	level        byte
+
+	mod          fdsEnvelope
+	modFrequency uint16
+	modHalt      bool
+	modCounter   int8
+	modTable     [64]byte
+	modPos       byte
+	modAcc       uint32
+	modOutput    int
+}
+
+func (a *fdsAudio) reset() {
+	*a = fdsAudio{masterSpeed: 0xE8}
+}
+
+func (a *fdsAudio) read(address uint16) byte {
+	switch {
+	case address < 0x4080:
+		return a.wave[address-0x4040]
+	case address == 0x4090:
+		return a.volume.gain
+	case address == 0x4092:
+		return a.mod.gain
+	}
+	return 0
+}
+
+func (a *fdsAudio) write(address uint16, value byte) {
+	switch {
+	case address < 0x4080:
+		if a.waveWrite {
+			a.wave[address-0x4040] = value & 0x3F
+		}
+	case address == 0x4080:
+		a.volume.write(value, a.masterSpeed)
+	case address == 0x4082:
+		a.frequency = a.frequency&0x0F00 | uint16(value)
+	case address == 0x4083:
+		a.frequency = a.frequency&0x00FF | uint16(value&0x0F)<<8
+		a.haltWave = value&0x80 != 0
+		a.haltEnvelope = value&0x40 != 0
+		if a.haltWave {
+			a.wavePos = 0
+			a.waveAcc = 0
+		}
+		if a.haltEnvelope {
+			a.volume.resetTimer(a.masterSpeed)
+			a.mod.resetTimer(a.masterSpeed)
+		}
+	case address == 0x4084:
+		a.mod.write(value, a.masterSpeed)
+	case address == 0x4085:
+		a.modCounter = int8(value<<1) >> 1
+	case address == 0x4086:
+		a.modFrequency = a.modFrequency&0x0F00 | uint16(value)
+	case address == 0x4087:
+		a.modFrequency = a.modFrequency&0x00FF | uint16(value&0x0F)<<8
+		a.modHalt = value&0x80 != 0
+		if a.modHalt {
+			a.modAcc = 0
+		}
+	case address == 0x4088:
+		// The table is only writable while the modulator is halted, each
+		// write fills two entries.
+		if a.modHalt {
+			a.modTable[a.modPos] = value & 0x07
+			a.modTable[a.modPos+1] = value & 0x07
+			a.modPos = (a.modPos + 2) & 0x3F
+		}
+	case address == 0x4089:
+		a.waveWrite = value&0x80 != 0
+		a.masterVolume = value & 0x03
+	case address == 0x408A:
+		a.masterSpeed = value
+		a.volume.resetTimer(a.masterSpeed)
+		a.mod.resetTimer(a.masterSpeed)
+	}
+}
+
+// clock advance the channel by one CPU cycle
+func (a *fdsAudio) clock() {
+	if !a.haltWave && !a.haltEnvelope {
+		a.volume.clock(a.masterSpeed)
+		a.mod.clock(a.masterSpeed)
+	}
+	if !a.modHalt && a.modFrequency > 0 {
+		a.modAcc += uint32(a.modFrequency)
+		if a.modAcc > 0xFFFF {
+			a.modAcc &= 0xFFFF
+			adjust := a.modTable[a.modPos]
+			if adjust == 4 {
+				a.modCounter = 0
+			} else {
+				a.modCounter = int8(byte(int(a.modCounter)+fdsModAdjust[adjust])<<1) >> 1
+			}
+			a.modPos = (a.modPos + 1) & 0x3F
+		}
+	}
+	a.updateModOutput()
+
+	if a.haltWave {
+		a.wavePos = 0
+	} else if pitch := int(a.frequency) + a.modOutput; pitch > 0 && !a.waveWrite {
+		a.waveAcc += uint32(pitch)
+		if a.waveAcc > 0xFFFF {
+			a.waveAcc &= 0xFFFF
+			a.wavePos = (a.wavePos + 1) & 0x3F
+		}
+	}
+	if !a.waveWrite {
+		// The output only updates while the wave table is not being written.
+		a.level = a.wave[a.wavePos]
+	}
+}
+
+// updateModOutput compute the pitch offset from the mod counter and gain
+func (a *fdsAudio) updateModOutput() {
+	temp := int(a.modCounter) * int(a.mod.gain)
+	remainder := temp & 0x0F
+	temp >>= 4
+	if remainder > 0 && temp&0x80 == 0 {
+		if a.modCounter < 0 {
+			temp--
+		} else {
+			temp += 2
+		}
+	}
+	if temp >= 192 {
+		temp -= 256
+	} else if temp < -64 {
+		temp += 256
+	}
+	temp *= int(a.frequency)
+	remainder = temp & 0x3F
+	temp >>= 6
+	if remainder >= 32 {
+		temp++
+	}
+	a.modOutput = temp
+}
+
+// output returns the channel level in [0, 1]
+func (a *fdsAudio) output() float32 {
+	gain := a.volume.gain
+	if gain > 32 {
+		gain = 32
+	}
+	return float32(a.level) * float32(gain) / (63 * 32) * fdsMasterVolume[a.masterVolume]
+}
+
+func (e *fdsEnvelope) saveState(enc *stateEncoder) {
+	enc.byte(e.speed)
+	enc.byte(e.gain)
+	enc.bool(e.increase)
+	enc.bool(e.off)
+	enc.int(e.timer)
+}
+
+func (e *fdsEnvelope) loadState(d *stateDecoder) {
+	e.speed = d.byte()
+	e.gain = d.byte()
+	e.increase = d.bool()
+	e.off = d.bool()
+	e.timer = d.int()
+}
+
+func (a *fdsAudio) saveState(e *stateEncoder) {
+	e.bytes(a.wave[:])
+	e.bool(a.waveWrite)
+	e.byte(a.masterVolume)
+	e.byte(a.masterSpeed)
+	a.volume.saveState(e)
+	e.uint16(a.frequency)
+	e.bool(a.haltWave)
+	e.bool(a.haltEnvelope)
+	e.uint64(uint64(a.waveAcc))
+	e.byte(a.wavePos)
+	e.byte(a.level)
+	a.mod.saveState(e)
+	e.uint16(a.modFrequency)
+	e.bool(a.modHalt)
+	e.byte(byte(a.modCounter))
+	e.bytes(a.modTable[:])
+	e.byte(a.modPos)
+	e.uint64(uint64(a.modAcc))
+	e.int(a.modOutput)
+}
+
+func (a *fdsAudio) loadState(d *stateDecoder) {
+	d.bytes(a.wave[:])
+	a.waveWrite = d.bool()
+	a.masterVolume = d.byte()
+	a.masterSpeed = d.byte()
+	a.volume.loadState(d)
+	a.frequency = d.uint16()
+	a.haltWave = d.bool()
+	a.haltEnvelope = d.bool()
+	a.waveAcc = uint32(d.uint64())
+	a.wavePos = d.byte()
+	a.level = d.byte()
+	a.mod.loadState(d)
+	a.modFrequency = d.uint16()
+	a.modHalt = d.bool()
+	a.modCounter = int8(d.byte())
+	d.bytes(a.modTable[:])
+	a.modPos = d.byte()
+	a.modAcc = uint32(d.uint64())
+	a.modOutput = d.int()
+	if d.err != nil {
+		return
+	}
+	// values used as indexes, which a corrupt state must not push out of range
+	switch {
+	case a.masterVolume > 3:
+		d.err = fmt.Errorf("save state has FDS master volume %d", a.masterVolume)
+	case a.wavePos > 63:
+		d.err = fmt.Errorf("save state has FDS wave position %d", a.wavePos)
+	case a.modPos > 63:
+		d.err = fmt.Errorf("save state has FDS mod position %d", a.modPos)
+	}
+	for _, adjust := range a.modTable {
+		if d.err == nil && int(adjust) >= len(fdsModAdjust) {
+			d.err = fmt.Errorf("save state has FDS mod table entry %d", adjust)
+		}
+	}
+}
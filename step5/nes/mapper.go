@@ -10,14 +10,35 @@ type Mapper interface {
 	Write(address uint16, value byte)
 }
 
+// ClockedMapper is implemented by mappers with hardware driven by the CPU
+// clock, such as IRQ counters. Clock is called after every instruction
+// with the number of cycles it took.
+type ClockedMapper interface {
+	Clock(cpu *CPU, cycles int)
+}
+
+// AudioMapper is implemented by mappers with expansion sound
+type AudioMapper interface {
+	// AudioOutput returns the current expansion sound level in [0, 1].
+	AudioOutput() float32
+}
+
+// mappers are the mapper constructors by iNES mapper number
+var mappers = map[int]func(cart *Cartridge) Mapper{
+	0: func(cart *Cartridge) Mapper { return NewMapper0(cart) },
+}
+
+// MapperImplemented returns whether NewMapper supports a mapper number
+func MapperImplemented(id int) bool {
+	_, ok := mappers[id]
+	return ok
+}
+
 // NewMapper create a mapper
 func NewMapper(id int, cart *Cartridge) (Mapper, error) {
-	var mapper Mapper
-	switch id {
-	case 0:
-		mapper = NewMapper0(cart)
-	default:
+	newMapper, ok := mappers[id]
+	if !ok {
 		return nil, fmt.Errorf("mapper ID %d not implemented", id)
 	}
-	return mapper, nil
+	return newMapper(cart), nil
 }
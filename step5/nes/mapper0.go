@@ -39,6 +39,9 @@ func (m *Mapper0) Read(address uint16) byte {
 		return m.PRG[m.prgBank1][address-0x8000]
 	case address >= 0x6000:
 		return m.SRAM[0][address-0x6000]
+	case address >= 0x4020:
+		// No expansion hardware, open bus.
+		return 0
 	default:
 		log.Fatalf("Mapper 0 unhandle read address %x", address)
 	}
@@ -48,6 +51,10 @@ func (m *Mapper0) Read(address uint16) byte {
 func (m *Mapper0) Write(address uint16, value byte) {
 	switch {
 	case address < 0x2000:
+		if !m.CHRRAM {
+			log.Warning(fmt.Sprintf("try to write CHR-ROM address %x", address))
+			return
+		}
 		m.CHR[0][address] = value
 	case address >= 0x8000:
 		log.Warning(fmt.Sprintf("try to write address %x", address))
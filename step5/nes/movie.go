@@ -0,0 +1,436 @@
+package nes
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Movie frame commands, as in FM2
+const (
+	MovieReset = 1 << 0
+	MoviePower = 1 << 1
+)
+
+// MovieFrame is the input of one frame
+type MovieFrame struct {
+	Command byte
+	// Buttons has bit n set when button n, ButtonA to ButtonRight, is held
+	Buttons [2]byte
+	// Lag is set when the game did not read the joypads in this frame.
+	Lag bool
+}
+
+// Movie is the joypad input of every frame, from power on or from a save
+// state, for replaying a run exactly
+type Movie struct {
+	ROMName   string
+	SHA1      string
+	MD5       []byte // FM2 romChecksum
+	PAL       bool
+	State     []byte // save state the movie starts from, nil for power on
+	Rerecords int
+	Frames    []MovieFrame
+}
+
+// movie modes
+const (
+	movieOff = iota
+	movieRecording
+	moviePlaying
+)
+
+// movieState is the movie a console records or plays
+type movieState struct {
+	movie *Movie
+	mode  int
+	start int // console frame of the first movie frame
+}
+
+// buttonsByte pack joypad buttons into a MovieFrame byte
+func buttonsByte(buttons [8]bool) byte {
+	var b byte
+	for i, pressed := range buttons {
+		if pressed {
+			b |= 1 << uint(i)
+		}
+	}
+	return b
+}
+
+// byteButtons unpack a MovieFrame byte
+func byteButtons(b byte) [8]bool {
+	var buttons [8]bool
+	for i := range buttons {
+		buttons[i] = b&(1<<uint(i)) != 0
+	}
+	return buttons
+}
+
+// romMD5 returns the MD5 of the PRG and CHR ROM, as FCEUX computes it
+func romMD5(cart *Cartridge) []byte {
+	sum := md5.New()
+	for _, bank := range cart.PRG {
+		sum.Write(bank)
+	}
+	if !cart.CHRRAM {
+		for _, bank := range cart.CHR {
+			sum.Write(bank)
+		}
+	}
+	return sum.Sum(nil)
+}
+
+// RecordMovie start recording the joypads into a new movie, after a power
+// cycle or, with fromState, from the current state
+func (console *Console) RecordMovie(romName string, fromState bool) *Movie {
+	movie := &Movie{
+		ROMName: strings.TrimSuffix(filepath.Base(romName), filepath.Ext(romName)),
+		SHA1:    console.Cart.SHA1,
+		MD5:     romMD5(console.Cart),
+		PAL:     console.Cart.Region == RegionPAL,
+	}
+	if fromState {
+		var state bytes.Buffer
+		console.SaveState(&state)
+		movie.State = state.Bytes()
+	} else {
+		console.power()
+	}
+	console.movie = movieState{movie: movie, mode: movieRecording, start: console.Frame}
+	return movie
+}
+
+// PlayMovie restore the start of a movie and replay its input. The joypads
+// are ignored until it ends.
+func (console *Console) PlayMovie(movie *Movie) error {
+	if movie.SHA1 != "" && movie.SHA1 != console.Cart.SHA1 {
+		return errors.New("movie is for another ROM")
+	}
+	if movie.SHA1 == "" && movie.MD5 != nil && !bytes.Equal(movie.MD5, romMD5(console.Cart)) {
+		log.Warning("movie ROM checksum does not match, it may desync")
+	}
+	if movie.State != nil {
+		if err := console.LoadState(bytes.NewReader(movie.State)); err != nil {
+			return err
+		}
+	} else {
+		console.power()
+	}
+	console.movie = movieState{movie: movie, mode: moviePlaying, start: console.Frame}
+	return nil
+}
+
+// StopMovie stop recording or playing, it returns the movie
+func (console *Console) StopMovie() *Movie {
+	movie := console.movie.movie
+	console.movie = movieState{}
+	return movie
+}
+
+// MovieStatus returns "recording", "playing" or "" and the position in the
+// movie
+func (console *Console) MovieStatus() (string, int, int) {
+	m := console.movie
+	switch m.mode {
+	case movieRecording:
+		return "recording", console.Frame - m.start, len(m.movie.Frames)
+	case moviePlaying:
+		return "playing", console.Frame - m.start, len(m.movie.Frames)
+	}
+	return "", 0, 0
+}
+
+// movieBeforeFrame set the joypads and commands of a played frame
+func (console *Console) movieBeforeFrame() {
+	m := &console.movie
+	if m.mode != moviePlaying {
+		return
+	}
+	i := console.Frame - m.start
+	if i < 0 || i >= len(m.movie.Frames) {
+		console.movie = movieState{}
+		return
+	}
+	frame := m.movie.Frames[i]
+	console.command = frame.Command
+	console.CPU.Joypads[0].SetButtons(byteButtons(frame.Buttons[0]))
+	console.CPU.Joypads[1].SetButtons(byteButtons(frame.Buttons[1]))
+}
+
+// movieAfterFrame append a recorded frame, or note the lag of a played one
+func (console *Console) movieAfterFrame(command byte) {
+	m := &console.movie
+	i := console.Frame - m.start
+	switch m.mode {
+	case movieRecording:
+		m.movie.Frames = append(m.movie.Frames[:i], MovieFrame{
+			Command: command,
+			Buttons: [2]byte{
+				buttonsByte(console.CPU.Joypads[0].buttons),
+				buttonsByte(console.CPU.Joypads[1].buttons),
+			},
+			Lag: console.Lag,
+		})
+	case moviePlaying:
+		m.movie.Frames[i].Lag = console.Lag
+		if i+1 == len(m.movie.Frames) {
+			log.Info("movie finished")
+			console.movie = movieState{}
+		}
+	}
+}
+
+// movieLoadedState follow a save state being loaded: a recording goes back
+// to that frame and counts a rerecord, playback continues from it. Loading
+// a state from before the movie started stops it.
+func (console *Console) movieLoadedState() {
+	m := &console.movie
+	if m.mode == movieOff {
+		return
+	}
+	i := console.Frame - m.start
+	if i < 0 || i > len(m.movie.Frames) {
+		console.movie = movieState{}
+		return
+	}
+	if m.mode == movieRecording {
+		m.movie.Frames = m.movie.Frames[:i]
+		m.movie.Rerecords++
+	}
+}
+
+// LoadMovie read a movie in FM2 or the native format
+func LoadMovie(filename string) (*Movie, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var movie *Movie
+	if bytes.HasPrefix(data, []byte(movieMagic)) {
+		movie, err = readNativeMovie(data)
+	} else {
+		movie, err = readFM2(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+	return movie, nil
+}
+
+// SaveMovie write a movie, as FM2 for a .fm2 file name and in the native
+// format otherwise
+func (movie *Movie) SaveMovie(filename string) error {
+	var buf bytes.Buffer
+	if strings.EqualFold(filepath.Ext(filename), ".fm2") {
+		if err := movie.writeFM2(&buf); err != nil {
+			return err
+		}
+	} else {
+		movie.writeNative(&buf)
+	}
+	return WriteFileAtomic(filename, buf.Bytes())
+}
+
+// Native movie format: the magic "NESM", a version, then the fields below
+// encoded like a save state section, then three bytes per frame: the
+// command with bit 7 set for lag frames, and both joypads.
+const (
+	movieMagic   = "NESM"
+	movieVersion = 1
+	movieLagBit  = 0x80
+)
+
+func (movie *Movie) writeNative(w io.Writer) {
+	var e stateEncoder
+	e.buf.WriteString(movieMagic)
+	e.uint16(movieVersion)
+	e.bytes([]byte(movie.ROMName))
+	e.bytes([]byte(movie.SHA1))
+	e.bytes(movie.MD5)
+	e.bool(movie.PAL)
+	e.bytes(movie.State)
+	e.int(movie.Rerecords)
+	e.int(len(movie.Frames))
+	for _, frame := range movie.Frames {
+		command := frame.Command
+		if frame.Lag {
+			command |= movieLagBit
+		}
+		e.byte(command)
+		e.byte(frame.Buttons[0])
+		e.byte(frame.Buttons[1])
+	}
+	w.Write(e.buf.Bytes())
+}
+
+func readNativeMovie(data []byte) (*Movie, error) {
+	d := &stateDecoder{tag: movieMagic, r: bytes.NewReader(data[len(movieMagic):])}
+	if version := d.uint16(); version != movieVersion {
+		return nil, fmt.Errorf("movie version %d, want %d", version, movieVersion)
+	}
+	movie := &Movie{
+		ROMName: string(d.block()),
+		SHA1:    string(d.block()),
+		MD5:     d.block(),
+		PAL:     d.bool(),
+		State:   d.block(),
+	}
+	movie.Rerecords = d.int()
+	n := d.int()
+	if d.err == nil && (n < 0 || n*3 > d.r.Len()) {
+		return nil, errors.New("movie is truncated")
+	}
+	for i := 0; i < n && d.err == nil; i++ {
+		command := d.byte()
+		movie.Frames = append(movie.Frames, MovieFrame{
+			Command: command &^ movieLagBit,
+			Buttons: [2]byte{d.byte(), d.byte()},
+			Lag:     command&movieLagBit != 0,
+		})
+	}
+	if len(movie.MD5) == 0 {
+		movie.MD5 = nil
+	}
+	if len(movie.State) == 0 {
+		movie.State = nil
+	}
+	return movie, d.err
+}
+
+// fm2Buttons are the FM2 joypad columns, from bit 7 to bit 0
+const fm2Buttons = "RLDUTSBA"
+
+// readFM2 parse a text FCEUX movie
+//
+// http://fceux.com/web/help/fm2.html
+func readFM2(r io.Reader) (*Movie, error) {
+	movie := &Movie{}
+	ports := [3]string{"1", "1", "0"}
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		if strings.HasPrefix(text, "|") {
+			frame, err := parseFM2Frame(text, ports)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", line, err)
+			}
+			movie.Frames = append(movie.Frames, frame)
+			continue
+		}
+		fields := strings.SplitN(text, " ", 2)
+		key, value := fields[0], ""
+		if len(fields) == 2 {
+			value = fields[1]
+		}
+		switch key {
+		case "version":
+			if value != "3" {
+				return nil, fmt.Errorf("FM2 version %s, want 3", value)
+			}
+		case "binary":
+			if value != "0" {
+				return nil, errors.New("binary FM2 input is not supported")
+			}
+		case "palFlag":
+			movie.PAL = value == "1"
+		case "romFilename":
+			movie.ROMName = value
+		case "romChecksum":
+			sum, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, "base64:"))
+			if err == nil {
+				movie.MD5 = sum
+			}
+		case "rerecordCount":
+			movie.Rerecords, _ = strconv.Atoi(value)
+		case "fourscore":
+			if value == "1" {
+				return nil, errors.New("four score FM2 movies are not supported")
+			}
+		case "port0", "port1", "port2":
+			ports[key[4]-'0'] = value
+		case "savestate":
+			return nil, errors.New("FM2 movies starting from an FCEUX save state are not supported")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if ports[0] != "1" && ports[0] != "0" || ports[1] != "1" && ports[1] != "0" {
+		return nil, errors.New("only joypads are supported on ports 0 and 1")
+	}
+	return movie, nil
+}
+
+// parseFM2Frame parse an input line, "|commands|port0|port1|port2|"
+func parseFM2Frame(text string, ports [3]string) (MovieFrame, error) {
+	var frame MovieFrame
+	fields := strings.Split(text, "|")
+	if len(fields) < 5 {
+		return frame, errors.New("bad input line")
+	}
+	command, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return frame, fmt.Errorf("bad command %q", fields[1])
+	}
+	frame.Command = byte(command) & (MovieReset | MoviePower)
+	for player := 0; player < 2; player++ {
+		pad := fields[2+player]
+		if ports[player] != "1" {
+			continue
+		}
+		if len(pad) != len(fm2Buttons) {
+			return frame, fmt.Errorf("bad joypad %q", pad)
+		}
+		for i := 0; i < len(pad); i++ {
+			if pad[i] != '.' && pad[i] != ' ' {
+				frame.Buttons[player] |= 1 << uint(7-i)
+			}
+		}
+	}
+	return frame, nil
+}
+
+// writeFM2 write the movie as a text FCEUX movie. Movies starting from a
+// save state can only be kept in the native format, FCEUX could not load
+// the state.
+func (movie *Movie) writeFM2(w io.Writer) error {
+	if movie.State != nil {
+		return errors.New("movies starting from a save state can only be saved in the native format")
+	}
+	out := bufio.NewWriter(w)
+	pal := 0
+	if movie.PAL {
+		pal = 1
+	}
+	var guid [16]byte
+	rand.Read(guid[:])
+	fmt.Fprintf(out, "version 3\nemuVersion 22020\nrerecordCount %d\npalFlag %d\n", movie.Rerecords, pal)
+	fmt.Fprintf(out, "romFilename %s\nromChecksum base64:%s\n", movie.ROMName, base64.StdEncoding.EncodeToString(movie.MD5))
+	fmt.Fprintf(out, "guid %X-%X-%X-%X-%X\n", guid[0:4], guid[4:6], guid[6:8], guid[8:10], guid[10:])
+	fmt.Fprintf(out, "fourscore 0\nmicrophone 0\nport0 1\nport1 1\nport2 0\nFDS 0\nNewPPU 0\n")
+	for _, frame := range movie.Frames {
+		fmt.Fprintf(out, "|%d|", frame.Command)
+		for _, b := range frame.Buttons {
+			for i := 0; i < len(fm2Buttons); i++ {
+				if b&(1<<uint(7-i)) != 0 {
+					out.WriteByte(fm2Buttons[i])
+				} else {
+					out.WriteByte('.')
+				}
+			}
+			out.WriteByte('|')
+		}
+		out.WriteString("|\n")
+	}
+	return out.Flush()
+}
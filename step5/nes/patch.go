@@ -0,0 +1,322 @@
+package nes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// patchExtensions are the soft-patch formats looked for next to a ROM
+var patchExtensions = []string{".ips", ".bps", ".ups"}
+
+// FindPatch returns a patch file with the same base name as romFile,
+// e.g. "game.nes" -> "game.ips", or "" if there is none
+func FindPatch(romFile string) string {
+	base := strings.TrimSuffix(romFile, filepath.Ext(romFile))
+	for _, ext := range patchExtensions {
+		if _, err := os.Stat(base + ext); err == nil {
+			return base + ext
+		}
+	}
+	return ""
+}
+
+// ApplyPatchFile apply an IPS, BPS or UPS patch file to a ROM image
+func ApplyPatchFile(rom []byte, patchFile string) ([]byte, error) {
+	patch, err := os.ReadFile(patchFile)
+	if err != nil {
+		return nil, err
+	}
+	out, err := ApplyPatch(rom, patch)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filepath.Base(patchFile), err)
+	}
+	log.Debug("applied patch " + patchFile)
+	return out, nil
+}
+
+// ApplyPatch apply an IPS, BPS or UPS patch to a ROM image in memory. The
+// format is detected from the patch magic. BPS and UPS patches made for a
+// headerless ROM are applied below the iNES header.
+func ApplyPatch(rom []byte, patch []byte) ([]byte, error) {
+	var apply func([]byte, []byte) ([]byte, error)
+	switch {
+	case bytes.HasPrefix(patch, []byte("PATCH")):
+		return applyIPS(rom, patch)
+	case bytes.HasPrefix(patch, []byte("BPS1")):
+		apply = applyBPS
+	case bytes.HasPrefix(patch, []byte("UPS1")):
+		apply = applyUPS
+	default:
+		return nil, errors.New("unknown patch format")
+	}
+	out, err := apply(rom, patch)
+	if err == errSourceChecksum && len(rom) > 16 && bytes.HasPrefix(rom, []byte("NES\x1a")) {
+		if out, err = apply(rom[16:], patch); err == nil {
+			return append(append([]byte{}, rom[:16]...), out...), nil
+		}
+	}
+	return out, err
+}
+
+var (
+	errSourceChecksum = errors.New("source checksum mismatch, patch is for a different ROM")
+	errTargetChecksum = errors.New("target checksum mismatch, patched ROM is corrupt")
+	errPatchChecksum  = errors.New("patch checksum mismatch, patch file is corrupt")
+	errPatchTruncated = errors.New("patch file is truncated")
+	errPatchTooLarge  = fmt.Errorf("patched ROM would be larger than %d bytes", maxROMSize)
+)
+
+// applyIPS apply an International Patching System patch
+//
+// https://zerosoft.zophar.net/ips.php
+func applyIPS(rom []byte, patch []byte) ([]byte, error) {
+	out := append([]byte{}, rom...)
+	p := 5
+	for {
+		if p+3 > len(patch) {
+			return nil, errPatchTruncated
+		}
+		if string(patch[p:p+3]) == "EOF" {
+			p += 3
+			break
+		}
+		if p+5 > len(patch) {
+			return nil, errPatchTruncated
+		}
+		offset := int(patch[p])<<16 | int(patch[p+1])<<8 | int(patch[p+2])
+		size := int(binary.BigEndian.Uint16(patch[p+3:]))
+		p += 5
+		var data []byte
+		if size == 0 {
+			// RLE record: 16-bit count followed by the fill byte.
+			if p+3 > len(patch) {
+				return nil, errPatchTruncated
+			}
+			size = int(binary.BigEndian.Uint16(patch[p:]))
+			data = bytes.Repeat(patch[p+2:p+3], size)
+			p += 3
+		} else {
+			if p+size > len(patch) {
+				return nil, errPatchTruncated
+			}
+			data = patch[p : p+size]
+			p += size
+		}
+		if offset+size > len(out) {
+			out = append(out, make([]byte, offset+size-len(out))...)
+		}
+		copy(out[offset:], data)
+	}
+	// Optional truncation extension.
+	if p+3 <= len(patch) {
+		size := int(patch[p])<<16 | int(patch[p+1])<<8 | int(patch[p+2])
+		if size < len(out) {
+			out = out[:size]
+		}
+	}
+	return out, nil
+}
+
+// patchReader reads the variable length numbers used by BPS and UPS
+type patchReader struct {
+	data []byte
+	pos  int
+	end  int
+	err  error
+}
+
+func (r *patchReader) byte() byte {
+	if r.pos >= r.end {
+		r.err = errPatchTruncated
+		return 0
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *patchReader) number() uint64 {
+	var value uint64
+	shift := uint64(1)
+	for r.err == nil {
+		x := r.byte()
+		value += uint64(x&0x7f) * shift
+		if x&0x80 != 0 {
+			break
+		}
+		shift <<= 7
+		value += shift
+	}
+	return value
+}
+
+// checkFooter verify the three CRC32s that end BPS and UPS patches
+func checkFooter(source []byte, target []byte, patch []byte) error {
+	footer := patch[len(patch)-12:]
+	if crc32.ChecksumIEEE(patch[:len(patch)-4]) != binary.LittleEndian.Uint32(footer[8:]) {
+		return errPatchChecksum
+	}
+	if crc32.ChecksumIEEE(source) != binary.LittleEndian.Uint32(footer[0:]) {
+		return errSourceChecksum
+	}
+	if target != nil && crc32.ChecksumIEEE(target) != binary.LittleEndian.Uint32(footer[4:]) {
+		return errTargetChecksum
+	}
+	return nil
+}
+
+// applyBPS apply a beat patch
+//
+// https://www.romhacking.net/documents/746/
+func applyBPS(source []byte, patch []byte) ([]byte, error) {
+	if len(patch) < 4+12 {
+		return nil, errPatchTruncated
+	}
+	if err := checkFooter(source, nil, patch); err != nil {
+		return nil, err
+	}
+	r := &patchReader{data: patch, pos: 4, end: len(patch) - 12}
+	sourceSize := r.number()
+	targetSize := r.number()
+	metadataSize := r.number()
+	if r.err != nil || metadataSize > uint64(r.end-r.pos) {
+		return nil, errPatchTruncated
+	}
+	r.pos += int(metadataSize)
+	if sourceSize != uint64(len(source)) {
+		return nil, errSourceChecksum
+	}
+	if targetSize > maxROMSize {
+		return nil, errPatchTooLarge
+	}
+
+	target := make([]byte, targetSize)
+	out := 0
+	sourceRelative := 0
+	targetRelative := 0
+	for r.pos < r.end && r.err == nil {
+		data := r.number()
+		if data>>2 >= uint64(len(target)-out) {
+			return nil, errors.New("bps: write past end of target")
+		}
+		length := int(data>>2) + 1
+		if out+length > len(target) {
+			return nil, errors.New("bps: write past end of target")
+		}
+		switch data & 3 {
+		case 0: // SourceRead
+			if out+length > len(source) {
+				return nil, errors.New("bps: read past end of source")
+			}
+			copy(target[out:], source[out:out+length])
+			out += length
+		case 1: // TargetRead
+			if r.pos+length > r.end {
+				return nil, errPatchTruncated
+			}
+			copy(target[out:], patch[r.pos:r.pos+length])
+			r.pos += length
+			out += length
+		case 2: // SourceCopy
+			offset := r.number()
+			if offset>>1 > uint64(len(source)) {
+				return nil, errors.New("bps: source copy out of range")
+			}
+			if offset&1 != 0 {
+				sourceRelative -= int(offset >> 1)
+			} else {
+				sourceRelative += int(offset >> 1)
+			}
+			if sourceRelative < 0 || sourceRelative > len(source) || length > len(source)-sourceRelative {
+				return nil, errors.New("bps: source copy out of range")
+			}
+			copy(target[out:], source[sourceRelative:sourceRelative+length])
+			sourceRelative += length
+			out += length
+		case 3: // TargetCopy, byte by byte since the ranges may overlap
+			offset := r.number()
+			if offset>>1 > uint64(len(target)) {
+				return nil, errors.New("bps: target copy out of range")
+			}
+			if offset&1 != 0 {
+				targetRelative -= int(offset >> 1)
+			} else {
+				targetRelative += int(offset >> 1)
+			}
+			if targetRelative < 0 || targetRelative > len(target) || length > len(target)-targetRelative {
+				return nil, errors.New("bps: target copy out of range")
+			}
+			for i := 0; i < length; i++ {
+				target[out] = target[targetRelative]
+				out++
+				targetRelative++
+			}
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if err := checkFooter(source, target, patch); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
+
+// applyUPS apply a UPS patch
+//
+// http://www.romhacking.net/documents/392/
+func applyUPS(source []byte, patch []byte) ([]byte, error) {
+	if len(patch) < 4+12 {
+		return nil, errPatchTruncated
+	}
+	if err := checkFooter(source, nil, patch); err != nil {
+		return nil, err
+	}
+	r := &patchReader{data: patch, pos: 4, end: len(patch) - 12}
+	sourceSize := r.number()
+	targetSize := r.number()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if sourceSize != uint64(len(source)) {
+		return nil, errSourceChecksum
+	}
+	if targetSize > maxROMSize {
+		return nil, errPatchTooLarge
+	}
+
+	target := make([]byte, targetSize)
+	copy(target, source)
+	out := 0
+	for r.pos < r.end && r.err == nil {
+		// runs cover the source too when the target is smaller
+		skip := r.number()
+		if skip > uint64(len(target)+len(source)) {
+			return nil, errors.New("ups: write past end of target")
+		}
+		out += int(skip)
+		for r.err == nil {
+			x := r.byte()
+			if out < len(target) {
+				target[out] ^= x
+			}
+			out++
+			if x == 0 {
+				break
+			}
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if err := checkFooter(source, target, patch); err != nil {
+		return nil, err
+	}
+	return target, nil
+}
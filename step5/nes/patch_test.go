@@ -0,0 +1,217 @@
+package nes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"math"
+	"strings"
+	"testing"
+)
+
+// patchNumber encode a BPS and UPS variable length number
+func patchNumber(v uint64) []byte {
+	var out []byte
+	for {
+		x := byte(v & 0x7f)
+		v >>= 7
+		if v == 0 {
+			return append(out, 0x80|x)
+		}
+		out = append(out, x)
+		v--
+	}
+}
+
+// patchFooter append the source, target and patch CRC32s
+func patchFooter(patch, source, target []byte) []byte {
+	patch = binary.LittleEndian.AppendUint32(patch, crc32.ChecksumIEEE(source))
+	patch = binary.LittleEndian.AppendUint32(patch, crc32.ChecksumIEEE(target))
+	return binary.LittleEndian.AppendUint32(patch, crc32.ChecksumIEEE(patch))
+}
+
+// bpsPatch build a beat patch writing target with a single TargetRead
+func bpsPatch(source, target []byte, targetSize uint64) []byte {
+	patch := []byte("BPS1")
+	patch = append(patch, patchNumber(uint64(len(source)))...)
+	patch = append(patch, patchNumber(targetSize)...)
+	patch = append(patch, patchNumber(0)...)
+	patch = append(patch, patchNumber(uint64(len(target)-1)<<2|1)...)
+	patch = append(patch, target...)
+	return patchFooter(patch, source, target)
+}
+
+// upsPatch build a UPS patch, runs of xored bytes between skips
+func upsPatch(source, target []byte, targetSize uint64) []byte {
+	patch := []byte("UPS1")
+	patch = append(patch, patchNumber(uint64(len(source)))...)
+	patch = append(patch, patchNumber(targetSize)...)
+	n := len(source)
+	if len(target) > n {
+		n = len(target)
+	}
+	xor := func(i int) byte {
+		var s, t byte
+		if i < len(source) {
+			s = source[i]
+		}
+		if i < len(target) {
+			t = target[i]
+		}
+		return s ^ t
+	}
+	last := 0
+	for i := 0; i < n; {
+		if xor(i) == 0 {
+			i++
+			continue
+		}
+		patch = append(patch, patchNumber(uint64(i-last))...)
+		for ; i < n && xor(i) != 0; i++ {
+			patch = append(patch, xor(i))
+		}
+		patch = append(patch, 0)
+		i++
+		last = i
+	}
+	return patchFooter(patch, source, target)
+}
+
+func TestApplyIPS(t *testing.T) {
+	rom := []byte{0, 1, 2, 3, 4, 5, 6, 7}
+	tests := []struct {
+		name  string
+		patch string
+		want  []byte
+		err   error
+	}{
+		{"record", "PATCH\x00\x00\x02\x00\x02\xAA\xBBEOF", []byte{0, 1, 0xAA, 0xBB, 4, 5, 6, 7}, nil},
+		{"rle", "PATCH\x00\x00\x01\x00\x00\x00\x03\xCCEOF", []byte{0, 0xCC, 0xCC, 0xCC, 4, 5, 6, 7}, nil},
+		{"grow", "PATCH\x00\x00\x09\x00\x01\xEEEOF", []byte{0, 1, 2, 3, 4, 5, 6, 7, 0, 0xEE}, nil},
+		{"truncate", "PATCHEOF\x00\x00\x04", []byte{0, 1, 2, 3}, nil},
+		{"no eof", "PATCH", nil, errPatchTruncated},
+		{"short record", "PATCH\x00\x00\x02\x00", nil, errPatchTruncated},
+		{"short data", "PATCH\x00\x00\x02\x00\x04\xAAEOF", nil, errPatchTruncated},
+		{"short rle", "PATCH\x00\x00\x02\x00\x00\x00", nil, errPatchTruncated},
+	}
+	for _, test := range tests {
+		got, err := ApplyPatch(rom, []byte(test.patch))
+		if err != test.err {
+			t.Errorf("%s: error %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("%s: % X, want % X", test.name, got, test.want)
+		}
+	}
+}
+
+func TestApplyBPSAndUPS(t *testing.T) {
+	source := []byte("source rom")
+	target := []byte("patched target rom")
+	other := []byte("another rom")
+	tests := []struct {
+		name   string
+		source []byte
+		patch  []byte
+		want   []byte
+		err    error
+	}{
+		{"bps", source, bpsPatch(source, target, uint64(len(target))), target, nil},
+		{"ups", source, upsPatch(source, target, uint64(len(target))), target, nil},
+		{"ups shrink", target, upsPatch(target, source, uint64(len(source))), source, nil},
+		{"bps wrong rom", other, bpsPatch(source, target, uint64(len(target))), nil, errSourceChecksum},
+		{"ups wrong rom", other, upsPatch(source, target, uint64(len(target))), nil, errSourceChecksum},
+		{"bps too large", source, bpsPatch(source, target, maxROMSize+1), nil, errPatchTooLarge},
+		{"ups too large", source, upsPatch(source, target, maxROMSize+1), nil, errPatchTooLarge},
+		{"bps short", source, []byte("BPS1\x80\x80"), nil, errPatchTruncated},
+		{"ups short", source, []byte("UPS1\x80\x80"), nil, errPatchTruncated},
+	}
+	for _, test := range tests {
+		got, err := ApplyPatch(test.source, test.patch)
+		if err != test.err {
+			t.Errorf("%s: error %v, want %v", test.name, err, test.err)
+			continue
+		}
+		if !bytes.Equal(got, test.want) {
+			t.Errorf("%s: %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// bpsCopyPatch build a beat patch of a single SourceCopy (action 2) or
+// TargetCopy (action 3) of length bytes from a relative offset
+func bpsCopyPatch(source []byte, action, length, offset uint64) []byte {
+	patch := []byte("BPS1")
+	patch = append(patch, patchNumber(uint64(len(source)))...)
+	patch = append(patch, patchNumber(length)...)
+	patch = append(patch, patchNumber(0)...)
+	patch = append(patch, patchNumber((length-1)<<2|action)...)
+	patch = append(patch, patchNumber(offset)...)
+	return patchFooter(patch, source, nil)
+}
+
+func TestApplyBPSMalformed(t *testing.T) {
+	source := []byte{1, 2, 3, 4}
+	tests := []struct {
+		name  string
+		patch []byte
+		err   string
+	}{
+		{"source copy huge offset", bpsCopyPatch(source, 2, 4, 2*(math.MaxInt64-1)), "source copy out of range"},
+		{"source copy huge negative offset", bpsCopyPatch(source, 2, 4, 2*(math.MaxInt64-1)|1), "source copy out of range"},
+		{"source copy past end", bpsCopyPatch(source, 2, 4, 2*1), "source copy out of range"},
+		{"source copy before start", bpsCopyPatch(source, 2, 4, 2*1|1), "source copy out of range"},
+		{"target copy huge offset", bpsCopyPatch(source, 3, 4, 2*(math.MaxInt64-1)), "target copy out of range"},
+		{"target copy past end", bpsCopyPatch(source, 3, 4, 2*1), "target copy out of range"},
+	}
+	for _, test := range tests {
+		_, err := ApplyPatch(source, test.patch)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestPatchChecksums(t *testing.T) {
+	source := []byte("source rom")
+	target := []byte("patched target rom")
+	for _, build := range []func([]byte, []byte, uint64) []byte{bpsPatch, upsPatch} {
+		patch := build(source, target, uint64(len(target)))
+		name := string(patch[:4])
+
+		corrupt := append([]byte{}, patch...)
+		corrupt[len(corrupt)-14] ^= 1
+		if _, err := ApplyPatch(source, corrupt); err != errPatchChecksum {
+			t.Errorf("%s corrupt patch: error %v, want %v", name, err, errPatchChecksum)
+		}
+
+		// a wrong target CRC, with the patch CRC fixed up
+		wrong := append([]byte{}, patch[:len(patch)-8]...)
+		wrong = binary.LittleEndian.AppendUint32(wrong, crc32.ChecksumIEEE(target)^1)
+		wrong = binary.LittleEndian.AppendUint32(wrong, crc32.ChecksumIEEE(wrong))
+		if _, err := ApplyPatch(source, wrong); err != errTargetChecksum {
+			t.Errorf("%s wrong target: error %v, want %v", name, err, errTargetChecksum)
+		}
+	}
+}
+
+func TestApplyPatchBelowHeader(t *testing.T) {
+	source := []byte("source rom")
+	target := []byte("patched target rom")
+	header := []byte("NES\x1a\x01\x01\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00")
+	rom := append(append([]byte{}, header...), source...)
+	got, err := ApplyPatch(rom, bpsPatch(source, target, uint64(len(target))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(append([]byte{}, header...), target...); !bytes.Equal(got, want) {
+		t.Errorf("% X, want % X", got, want)
+	}
+}
+
+func TestApplyPatchUnknown(t *testing.T) {
+	if _, err := ApplyPatch([]byte{1, 2, 3}, []byte("XYZ")); err == nil {
+		t.Error("unknown patch format applied")
+	}
+}
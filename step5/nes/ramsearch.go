@@ -0,0 +1,109 @@
+package nes
+
+import "fmt"
+
+// searchRanges are the CPU addresses a RAM search looks at: internal RAM
+// and the cartridge SRAM
+var searchRanges = [][2]int{{0x0000, 0x0800}, {0x6000, 0x8000}}
+
+// readValue read a 1 or 2 byte little endian value, sign extended when
+// signed
+func readValue(console *Console, address uint16, size int, signed bool) int64 {
+	value := int64(console.Peek(address))
+	if size == 2 {
+		value |= int64(console.Peek(address+1)) << 8
+	}
+	if signed {
+		if size == 2 {
+			return int64(int16(value))
+		}
+		return int64(int8(value))
+	}
+	return value
+}
+
+// SearchResult is an address left in a RAM search
+type SearchResult struct {
+	Address  uint16 `json:"address"`
+	Value    int64  `json:"value"`
+	Previous int64  `json:"previous"`
+}
+
+// RAMSearch narrows memory down to the addresses whose values change the
+// way asked, one filter at a time, typically with some frames in between
+type RAMSearch struct {
+	size    int
+	signed  bool
+	results []SearchResult
+}
+
+// NewRAMSearch start a search over 1 or 2 byte values with every address
+func NewRAMSearch(console *Console, size int, signed bool) (*RAMSearch, error) {
+	if size != 1 && size != 2 {
+		return nil, fmt.Errorf("RAM search values are 1 or 2 bytes, not %d", size)
+	}
+	s := &RAMSearch{size: size, signed: signed}
+	for _, r := range searchRanges {
+		for address := r[0]; address+size <= r[1]; address++ {
+			value := readValue(console, uint16(address), size, signed)
+			s.results = append(s.results, SearchResult{uint16(address), value, value})
+		}
+	}
+	return s, nil
+}
+
+// searchOps compare a current value with a previous or given one
+var searchOps = map[string]func(a, b int64) bool{
+	"eq": func(a, b int64) bool { return a == b },
+	"ne": func(a, b int64) bool { return a != b },
+	"lt": func(a, b int64) bool { return a < b },
+	"gt": func(a, b int64) bool { return a > b },
+	"le": func(a, b int64) bool { return a <= b },
+	"ge": func(a, b int64) bool { return a >= b },
+}
+
+// Filter keep the addresses whose current value compares to their value
+// at the last filter, or to operand when not nil, with op: eq, ne, lt, gt,
+// le or ge. "ne" with no operand keeps the changed values.
+func (s *RAMSearch) Filter(console *Console, op string, operand *int64) error {
+	compare, ok := searchOps[op]
+	if !ok {
+		return fmt.Errorf("unknown comparison %q, want eq, ne, lt, gt, le or ge", op)
+	}
+	kept := s.results[:0]
+	for _, r := range s.results {
+		value := readValue(console, r.Address, s.size, s.signed)
+		other := r.Value
+		if operand != nil {
+			other = *operand
+		}
+		if compare(value, other) {
+			kept = append(kept, SearchResult{r.Address, value, value})
+		}
+	}
+	s.results = kept
+	return nil
+}
+
+// Results returns the addresses left, with their values now and at the
+// previous filter
+func (s *RAMSearch) Results(console *Console) []SearchResult {
+	results := make([]SearchResult, len(s.results))
+	for i, r := range s.results {
+		results[i] = SearchResult{r.Address, readValue(console, r.Address, s.size, s.signed), r.Value}
+	}
+	return results
+}
+
+// Watch is a memory value shown live in the frontend
+type Watch struct {
+	Address uint16 `json:"address"`
+	Size    int    `json:"size"`
+	Signed  bool   `json:"signed"`
+	Name    string `json:"name"`
+}
+
+// Value read the watched value
+func (w Watch) Value(console *Console) int64 {
+	return readValue(console, w.Address, w.Size, w.Signed)
+}
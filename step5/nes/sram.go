@@ -0,0 +1,88 @@
+package nes
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SavePath returns the battery save file used for a ROM file, e.g.
+// "zelda.nes" -> "zelda.sav"
+func SavePath(romFile string) string {
+	return strings.TrimSuffix(romFile, filepath.Ext(romFile)) + ".sav"
+}
+
+// sramBytes returns all SRAM banks as one contiguous slice
+func (cart *Cartridge) sramBytes() []byte {
+	var buf bytes.Buffer
+	for _, bank := range cart.SRAM {
+		buf.Write(bank)
+	}
+	return buf.Bytes()
+}
+
+// LoadSRAM fill SRAM from a battery save file
+func (cart *Cartridge) LoadSRAM(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	rest := data
+	for i := range cart.SRAM {
+		n := copy(cart.SRAM[i], rest)
+		rest = rest[n:]
+	}
+	cart.savedSRAM = cart.sramBytes()
+	log.Debug("SRAM loaded from " + filename)
+	return nil
+}
+
+// SaveSRAM write SRAM to a battery save file. The file is replaced
+// atomically, so a crash while saving leaves the previous save intact.
+func (cart *Cartridge) SaveSRAM(filename string) error {
+	data := cart.sramBytes()
+	if err := WriteFileAtomic(filename, data); err != nil {
+		return err
+	}
+	cart.savedSRAM = data
+	return nil
+}
+
+// FlushSRAM save SRAM only if it changed since the last load or save
+func (cart *Cartridge) FlushSRAM(filename string) error {
+	if !cart.Battery {
+		return nil
+	}
+	if cart.savedSRAM != nil && bytes.Equal(cart.savedSRAM, cart.sramBytes()) {
+		return nil
+	}
+	return cart.SaveSRAM(filename)
+}
+
+// WriteFileAtomic write data to a temporary file in the same directory,
+// then rename it over filename
+func WriteFileAtomic(filename string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	// CreateTemp makes the file 0600, keep the mode os.WriteFile would give
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
@@ -0,0 +1,388 @@
+package nes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// Save state format: the magic "NESS", a version, then sections of a four
+// character tag, a length and the section data, and last the CRC32 of all
+// that, little endian. Loading skips sections it does not know, so new
+// sections can be added without bumping the version; changing an existing
+// section needs a new version.
+const (
+	stateMagic   = "NESS"
+	stateVersion = 2
+)
+
+// stateSection is a part of a save state under its own tag
+type stateSection struct {
+	tag  string
+	save func(e *stateEncoder)
+	load func(d *stateDecoder)
+}
+
+// stateMapper is implemented by mappers with state of their own, such as
+// bank registers, IRQ counters or writable disks. Their sections are saved
+// after the console ones.
+type stateMapper interface {
+	stateSections() []stateSection
+}
+
+// stateEncoder write the fields of a section
+type stateEncoder struct {
+	buf bytes.Buffer
+}
+
+func (e *stateEncoder) byte(v byte) {
+	e.buf.WriteByte(v)
+}
+
+func (e *stateEncoder) bool(v bool) {
+	if v {
+		e.buf.WriteByte(1)
+	} else {
+		e.buf.WriteByte(0)
+	}
+}
+
+func (e *stateEncoder) uint16(v uint16) {
+	binary.Write(&e.buf, binary.LittleEndian, v)
+}
+
+func (e *stateEncoder) uint64(v uint64) {
+	binary.Write(&e.buf, binary.LittleEndian, v)
+}
+
+func (e *stateEncoder) int(v int) {
+	binary.Write(&e.buf, binary.LittleEndian, int64(v))
+}
+
+func (e *stateEncoder) float64(v float64) {
+	binary.Write(&e.buf, binary.LittleEndian, v)
+}
+
+// bytes write a length prefixed block
+func (e *stateEncoder) bytes(v []byte) {
+	binary.Write(&e.buf, binary.LittleEndian, uint32(len(v)))
+	e.buf.Write(v)
+}
+
+// stateDecoder read the fields of a section. The first error sticks and
+// the following reads return zero values.
+type stateDecoder struct {
+	tag string
+	r   *bytes.Reader
+	err error
+}
+
+func (d *stateDecoder) read(v interface{}) {
+	if d.err != nil {
+		return
+	}
+	if err := binary.Read(d.r, binary.LittleEndian, v); err != nil {
+		d.err = fmt.Errorf("save state section %q is truncated", d.tag)
+	}
+}
+
+func (d *stateDecoder) byte() byte {
+	var v byte
+	d.read(&v)
+	return v
+}
+
+func (d *stateDecoder) bool() bool {
+	return d.byte() != 0
+}
+
+func (d *stateDecoder) uint16() uint16 {
+	var v uint16
+	d.read(&v)
+	return v
+}
+
+func (d *stateDecoder) uint64() uint64 {
+	var v uint64
+	d.read(&v)
+	return v
+}
+
+func (d *stateDecoder) int() int {
+	var v int64
+	d.read(&v)
+	return int(v)
+}
+
+func (d *stateDecoder) float64() float64 {
+	var v float64
+	d.read(&v)
+	return v
+}
+
+// bytes read a length prefixed block into dst, which must have the same
+// length
+func (d *stateDecoder) bytes(dst []byte) {
+	var n uint32
+	d.read(&n)
+	if d.err != nil {
+		return
+	}
+	if int(n) != len(dst) {
+		d.err = fmt.Errorf("save state section %q has %d bytes where %d are expected", d.tag, n, len(dst))
+		return
+	}
+	d.read(dst)
+}
+
+// block read a length prefixed block of any length
+func (d *stateDecoder) block() []byte {
+	var n uint32
+	d.read(&n)
+	if d.err != nil {
+		return nil
+	}
+	if int64(n) > int64(d.r.Len()) {
+		d.err = fmt.Errorf("save state section %q is truncated", d.tag)
+		return nil
+	}
+	block := make([]byte, n)
+	d.read(block)
+	return block
+}
+
+// stateSections returns the sections of the console, in save order
+func (console *Console) stateSections() []stateSection {
+	cpu, ppu, cart := console.CPU, console.PPU, console.Cart
+	sections := []stateSection{
+		{"ROM ", func(e *stateEncoder) {
+			e.bytes([]byte(cart.SHA1))
+		}, func(d *stateDecoder) {
+			// checked before loading, see LoadState
+		}},
+		{"CONS", func(e *stateEncoder) {
+			e.int(console.Frame)
+			e.float64(console.sampleTime)
+		}, func(d *stateDecoder) {
+			console.Frame = d.int()
+			console.sampleTime = d.float64()
+		}},
+		{"CPU ", func(e *stateEncoder) {
+			e.bytes(cpu.RAM[:])
+			e.uint64(cpu.Cycles)
+			e.uint16(cpu.PC)
+			e.byte(cpu.SP)
+			e.byte(cpu.A)
+			e.byte(cpu.X)
+			e.byte(cpu.Y)
+			e.byte(cpu.Flags())
+			e.byte(cpu.interrupt)
+			e.int(cpu.stall)
+		}, func(d *stateDecoder) {
+			d.bytes(cpu.RAM[:])
+			cpu.Cycles = d.uint64()
+			cpu.PC = d.uint16()
+			cpu.SP = d.byte()
+			cpu.A = d.byte()
+			cpu.X = d.byte()
+			cpu.Y = d.byte()
+			cpu.SetFlags(d.byte())
+			cpu.interrupt = d.byte()
+			cpu.stall = d.int()
+		}},
+		{"LAG ", func(e *stateEncoder) {
+			e.bool(console.Lag)
+			e.int(console.LagFrames)
+			e.byte(console.command)
+		}, func(d *stateDecoder) {
+			console.Lag = d.bool()
+			console.LagFrames = d.int()
+			console.command = d.byte()
+		}},
+		{"STEP", func(e *stateEncoder) {
+			e.bool(console.inFrame)
+			e.int(console.frameStep)
+			e.byte(console.frameCommand)
+			e.bool(cpu.inputRead)
+		}, func(d *stateDecoder) {
+			console.inFrame = d.bool()
+			console.frameStep = d.int()
+			console.frameCommand = d.byte()
+			cpu.inputRead = d.bool()
+		}},
+		{"PPU ", ppu.saveState, ppu.loadState},
+		{"PAD1", cpu.Joypads[0].saveState, cpu.Joypads[0].loadState},
+		{"PAD2", cpu.Joypads[1].saveState, cpu.Joypads[1].loadState},
+		{"CART", func(e *stateEncoder) {
+			e.int(int(cart.Mirror))
+			for _, bank := range cart.SRAM {
+				e.bytes(bank)
+			}
+			if cart.CHRRAM {
+				for _, bank := range cart.CHR {
+					e.bytes(bank)
+				}
+			}
+		}, func(d *stateDecoder) {
+			cart.Mirror = MirrorType(d.int())
+			for _, bank := range cart.SRAM {
+				d.bytes(bank)
+			}
+			if cart.CHRRAM {
+				for _, bank := range cart.CHR {
+					d.bytes(bank)
+				}
+			}
+		}},
+	}
+	if m, ok := cart.Mapper.(stateMapper); ok {
+		sections = append(sections, m.stateSections()...)
+	}
+	return sections
+}
+
+func (ppu *PPU) saveState(e *stateEncoder) {
+	e.int(ppu.Scanline)
+	e.int(ppu.Tick)
+	e.uint64(ppu.Frame)
+	e.uint64(ppu.numCycles)
+	e.bytes(ppu.ram[:])
+	e.bytes(ppu.sprRAM[:])
+	e.uint16(ppu.spriteTableAddress)
+	e.uint16(ppu.backgroundTableAddress)
+	for _, flag := range ppu.stateFlags() {
+		e.bool(*flag)
+	}
+	e.uint16(ppu.v)
+	e.uint16(ppu.t)
+	e.byte(ppu.x)
+	e.byte(ppu.w)
+	e.byte(ppu.sprIOAddress)
+	e.byte(ppu.readBuffer)
+}
+
+func (ppu *PPU) loadState(d *stateDecoder) {
+	ppu.Scanline = d.int()
+	ppu.Tick = d.int()
+	ppu.Frame = d.uint64()
+	ppu.numCycles = d.uint64()
+	d.bytes(ppu.ram[:])
+	d.bytes(ppu.sprRAM[:])
+	ppu.spriteTableAddress = d.uint16()
+	ppu.backgroundTableAddress = d.uint16()
+	for _, flag := range ppu.stateFlags() {
+		*flag = d.bool()
+	}
+	ppu.v = d.uint16()
+	ppu.t = d.uint16()
+	ppu.x = d.byte()
+	ppu.w = d.byte()
+	ppu.sprIOAddress = d.byte()
+	ppu.readBuffer = d.byte()
+}
+
+// stateFlags returns the PPU flags in save state order
+func (ppu *PPU) stateFlags() []*bool {
+	return []*bool{
+		&ppu.flagIncrementBy32, &ppu.flagLargeSprites, &ppu.flagNMIOnVBlank,
+		&ppu.flagColourMode, &ppu.flagClipBackground, &ppu.flagClipSprites,
+		&ppu.flagShowBackground, &ppu.flagShowSprites,
+		&ppu.flagRedEmphasis, &ppu.flagGreenEmphasis, &ppu.flagBlueEmphasis,
+		&ppu.flagVRAMWritesIgnored, &ppu.flagScanlineSpritesMax,
+		&ppu.flagSprite0Hit, &ppu.flagVBlankOutstanding,
+	}
+}
+
+func (joy *Joypad) saveState(e *stateEncoder) {
+	for _, b := range joy.buttons {
+		e.bool(b)
+	}
+	e.byte(joy.index)
+	e.byte(joy.strobe)
+}
+
+func (joy *Joypad) loadState(d *stateDecoder) {
+	for i := range joy.buttons {
+		joy.buttons[i] = d.bool()
+	}
+	joy.index = d.byte()
+	joy.strobe = d.byte()
+}
+
+// SaveState write a snapshot of the whole machine
+func (console *Console) SaveState(w io.Writer) error {
+	var out bytes.Buffer
+	out.WriteString(stateMagic)
+	binary.Write(&out, binary.LittleEndian, uint16(stateVersion))
+	for _, section := range console.stateSections() {
+		var e stateEncoder
+		section.save(&e)
+		out.WriteString(section.tag)
+		binary.Write(&out, binary.LittleEndian, uint32(e.buf.Len()))
+		out.Write(e.buf.Bytes())
+	}
+	binary.Write(&out, binary.LittleEndian, crc32.ChecksumIEEE(out.Bytes()))
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// LoadState restore a snapshot written by SaveState for the same ROM. On
+// error the machine is left as it was.
+func (console *Console) LoadState(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(data) < 6 || string(data[:4]) != stateMagic {
+		return errors.New("not a save state")
+	}
+	if version := binary.LittleEndian.Uint16(data[4:]); version != stateVersion {
+		return fmt.Errorf("save state version %d, want %d", version, stateVersion)
+	}
+	if len(data) < 10 {
+		return errors.New("save state is truncated")
+	}
+	sum := binary.LittleEndian.Uint32(data[len(data)-4:])
+	if data = data[:len(data)-4]; crc32.ChecksumIEEE(data) != sum {
+		return errors.New("save state is corrupt, its checksum does not match")
+	}
+	sections := map[string][]byte{}
+	for data = data[6:]; len(data) > 0; {
+		if len(data) < 8 {
+			return errors.New("save state is truncated")
+		}
+		tag, n := string(data[:4]), binary.LittleEndian.Uint32(data[4:])
+		data = data[8:]
+		if uint64(n) > uint64(len(data)) {
+			return fmt.Errorf("save state section %q is truncated", tag)
+		}
+		sections[tag] = data[:n]
+		data = data[n:]
+	}
+	rom := &stateDecoder{tag: "ROM ", r: bytes.NewReader(sections["ROM "])}
+	sha := make([]byte, len(console.Cart.SHA1))
+	rom.bytes(sha)
+	if rom.err != nil || string(sha) != console.Cart.SHA1 {
+		return errors.New("save state is for another ROM")
+	}
+
+	var backup bytes.Buffer
+	console.SaveState(&backup)
+	for _, section := range console.stateSections() {
+		data, ok := sections[section.tag]
+		if !ok {
+			continue
+		}
+		d := &stateDecoder{tag: section.tag, r: bytes.NewReader(data)}
+		section.load(d)
+		if d.err != nil {
+			console.LoadState(&backup)
+			return d.err
+		}
+	}
+	console.movieLoadedState()
+	return nil
+}
@@ -0,0 +1,59 @@
+package nes
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	console := newTestConsole(t)
+	console.CPU.RAM[0x10] = 0x42
+	console.CPU.A = 7
+	console.Frame = 12
+	var state bytes.Buffer
+	if err := console.SaveState(&state); err != nil {
+		t.Fatal(err)
+	}
+	console.CPU.RAM[0x10] = 0
+	console.CPU.A = 0
+	console.Frame = 0
+	if err := console.LoadState(bytes.NewReader(state.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if console.CPU.RAM[0x10] != 0x42 || console.CPU.A != 7 || console.Frame != 12 {
+		t.Errorf("loaded RAM $%02X A %d frame %d, want $42 7 12", console.CPU.RAM[0x10], console.CPU.A, console.Frame)
+	}
+}
+
+func TestStateCorrupt(t *testing.T) {
+	console := newTestConsole(t)
+	var state bytes.Buffer
+	console.SaveState(&state)
+	good := state.Bytes()
+	console.CPU.RAM[0x10] = 0x99
+
+	tests := []struct {
+		name  string
+		state []byte
+		err   string
+	}{
+		{"flipped byte", func() []byte {
+			b := append([]byte{}, good...)
+			b[len(b)/2] ^= 0x01
+			return b
+		}(), "checksum"},
+		{"truncated", good[:len(good)-1], "checksum"},
+		{"header only", good[:8], "truncated"},
+		{"not a state", []byte("hello world"), "not a save state"},
+	}
+	for _, test := range tests {
+		err := console.LoadState(bytes.NewReader(test.state))
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: error %v, want %q", test.name, err, test.err)
+		}
+		if console.CPU.RAM[0x10] != 0x99 {
+			t.Errorf("%s: the machine changed", test.name)
+		}
+	}
+}
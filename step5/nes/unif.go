@@ -0,0 +1,229 @@
+package nes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// unifBoards maps UNIF board names, without their "NES-", "UNL-", "HVC-",
+// "BTL-" or "BMC-" prefix, to iNES mapper numbers. Only the boards whose
+// mapper is implemented can be loaded, the others are known so they fail
+// with a clear error.
+var unifBoards = map[string]int{
+	"NROM":              0,
+	"NROM-128":          0,
+	"NROM-256":          0,
+	"RROM":              0,
+	"RROM-128":          0,
+	"SAROM":             1,
+	"SBROM":             1,
+	"SCROM":             1,
+	"SEROM":             1,
+	"SGROM":             1,
+	"SKROM":             1,
+	"SLROM":             1,
+	"SL1ROM":            1,
+	"SNROM":             1,
+	"SOROM":             1,
+	"SUROM":             1,
+	"SXROM":             1,
+	"UNROM":             2,
+	"UOROM":             2,
+	"CNROM":             3,
+	"TBROM":             4,
+	"TEROM":             4,
+	"TFROM":             4,
+	"TGROM":             4,
+	"TKROM":             4,
+	"TLROM":             4,
+	"TNROM":             4,
+	"TSROM":             4,
+	"TR1ROM":            4,
+	"EKROM":             5,
+	"ELROM":             5,
+	"ETROM":             5,
+	"EWROM":             5,
+	"ANROM":             7,
+	"AMROM":             7,
+	"AOROM":             7,
+	"PNROM":             9,
+	"FJROM":             10,
+	"FKROM":             10,
+	"CPROM":             13,
+	"BNROM":             34,
+	"TQROM":             119,
+	"GNROM":             66,
+	"MHROM":             66,
+	"NINA-001":          34,
+	"NINA-03":           79,
+	"NINA-06":           79,
+	"SA-0036":           149,
+	"SA-0037":           148,
+	"SA-72007":          145,
+	"SA-72008":          133,
+	"SA-NROM":           143,
+	"Sachen-8259A":      141,
+	"Sachen-8259B":      138,
+	"Sachen-8259C":      139,
+	"Sachen-8259D":      137,
+	"Sachen-74LS374N":   150,
+	"TC-U01-1.5M":       147,
+	"22211":             132,
+	"Supervision16in1":  53,
+	"Super24in1SC03":    176,
+	"42in1ResetSwitch":  233,
+	"64in1NoRepeat":     314,
+	"70in1":             236,
+	"70in1B":            236,
+	"Ghostbusters63in1": 226,
+	"MARIO1-MALEE2":     55,
+	"T-262":             265,
+	"D1038":             59,
+	"A65AS":             285,
+	"Cony":              83,
+	"KOF97":             263,
+	"SMB2J":             304,
+	"CC-21":             27,
+}
+
+// unifPrefixes are stripped from board names before the lookup
+var unifPrefixes = []string{"NES-", "UNL-", "HVC-", "BTL-", "BMC-", "IREM-", "KONAMI-", "TAITO-"}
+
+// UNIFBoardMapper returns the iNES mapper number for a UNIF board name. It
+// fails for boards whose mapper is not implemented yet.
+func UNIFBoardMapper(board string) (int, error) {
+	name := board
+	for _, prefix := range unifPrefixes {
+		name = strings.TrimPrefix(name, prefix)
+	}
+	id, ok := unifBoards[name]
+	if !ok {
+		return 0, fmt.Errorf("UNIF board %q not supported", board)
+	}
+	if !MapperImplemented(id) {
+		return 0, fmt.Errorf("UNIF board %s (mapper %d) is not supported", board, id)
+	}
+	return id, nil
+}
+
+// LoadUNIF read a UNIF format ROM image. UNIF files have a 32 byte header
+// followed by chunks made of a 4 byte ID, a 32-bit length and the data.
+//
+// http://wiki.nesdev.com/w/index.php/UNIF
+func LoadUNIF(data []byte) (*Cartridge, error) {
+	if len(data) < 32 || !bytes.HasPrefix(data, []byte("UNIF")) {
+		return nil, errors.New("not a valid UNIF file")
+	}
+	var board, name string
+	var prg, chr [16][]byte
+	mirror := -1
+	battery := false
+	region := RegionNTSC
+	chrRAM := false
+
+	for p := 32; p < len(data); {
+		if p+8 > len(data) {
+			return nil, errors.New("UNIF chunk header is truncated")
+		}
+		id := string(data[p : p+4])
+		length := int(binary.LittleEndian.Uint32(data[p+4:]))
+		p += 8
+		if length < 0 || p+length > len(data) {
+			return nil, fmt.Errorf("UNIF chunk %s is truncated", id)
+		}
+		chunk := data[p : p+length]
+		p += length
+
+		switch {
+		case id == "MAPR":
+			board = cString(chunk)
+		case id == "NAME":
+			name = cString(chunk)
+		case id == "MIRR" && length > 0:
+			mirror = int(chunk[0])
+		case id == "BATR":
+			battery = length == 0 || chunk[0] != 0
+		case id == "TVCI" && length > 0:
+			if chunk[0] == 1 {
+				region = RegionPAL
+			} else if chunk[0] == 2 {
+				region = RegionMulti
+			}
+		case id == "VROR":
+			chrRAM = true
+		case strings.HasPrefix(id, "PRG"):
+			if n, ok := unifChunkIndex(id); ok {
+				prg[n] = chunk
+			}
+		case strings.HasPrefix(id, "CHR"):
+			if n, ok := unifChunkIndex(id); ok {
+				chr[n] = chunk
+			}
+		}
+	}
+	if board == "" {
+		return nil, errors.New("UNIF file has no MAPR chunk")
+	}
+	mapperID, err := UNIFBoardMapper(board)
+	if err != nil {
+		return nil, err
+	}
+
+	prgData := bytes.Join(prg[:], nil)
+	chrData := bytes.Join(chr[:], nil)
+	if len(prgData) == 0 {
+		return nil, errors.New("UNIF file has no PRG chunk")
+	}
+	cart := NewCartridge((len(prgData)+16383)/16384, (len(chrData)+8191)/8192, 1)
+	for i := range cart.PRG {
+		copy(cart.PRG[i], prgData[i*16384:])
+	}
+	for i := 0; i < len(chrData); i += 8192 {
+		copy(cart.CHR[i/8192], chrData[i:])
+	}
+	if chrRAM {
+		cart.CHRRAM = true
+	}
+	switch mirror {
+	case 0:
+		cart.Mirror = horizontal
+	case 1:
+		cart.Mirror = vertical
+	case 2:
+		cart.Mirror = singleLow
+	case 3:
+		cart.Mirror = singleHigh
+	case 4:
+		cart.Mirror = fourScreen
+	}
+	cart.Battery = battery
+	cart.Region = region
+	cart.MapperID = mapperID
+	cart.Title = name
+	log.Printf("UNIF: board %s -> mapper %d, PRG %d bytes, CHR %d bytes", board, mapperID, len(prgData), len(chrData))
+
+	if err := cart.setupMapper(); err != nil {
+		return nil, fmt.Errorf("UNIF board %s: %v", board, err)
+	}
+	return cart, nil
+}
+
+// unifChunkIndex parse the hex digit of PRG0-PRGF and CHR0-CHRF chunk IDs
+func unifChunkIndex(id string) (int, bool) {
+	var n int
+	if _, err := fmt.Sscanf(id[3:], "%X", &n); err != nil || n > 15 {
+		return 0, false
+	}
+	return n, true
+}
+
+// cString returns a NUL terminated string
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
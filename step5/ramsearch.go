@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/shadow1163/nes-go/step5/nes"
+)
+
+// searchLimit is the most results listed, the count is always given
+const searchLimit = 500
+
+var (
+	// search is the RAM search in progress, if any
+	search *nes.RAMSearch
+	// watches are the values shown in the watch list
+	watches []nes.Watch
+)
+
+// searchHandler run the RAM search: action=start with size (1 or 2) and
+// signed begins with every address, action=filter with op (eq, ne, lt, gt,
+// le, ge) and an optional value keeps the addresses comparing to the value
+// or else to the previous one. It answers the count and the first results.
+func searchHandler(w http.ResponseWriter, r *http.Request) {
+	emu.Lock()
+	defer emu.Unlock()
+	switch action := r.FormValue("action"); action {
+	case "start":
+		size, _ := strconv.Atoi(r.FormValue("size"))
+		s, err := nes.NewRAMSearch(emu.console, size, r.FormValue("signed") == "true")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		search = s
+	case "filter":
+		if search == nil {
+			http.Error(w, "no search started", http.StatusConflict)
+			return
+		}
+		var operand *int64
+		if value := r.FormValue("value"); value != "" {
+			v, err := strconv.ParseInt(value, 0, 64)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("bad value %q", value), http.StatusBadRequest)
+				return
+			}
+			operand = &v
+		}
+		if err := search.Filter(emu.console, r.FormValue("op"), operand); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	case "":
+	default:
+		http.Error(w, fmt.Sprintf("unknown search action %q", action), http.StatusBadRequest)
+		return
+	}
+	results := []nes.SearchResult{}
+	if search != nil {
+		results = search.Results(emu.console)
+	}
+	count := len(results)
+	if count > searchLimit {
+		results = results[:searchLimit]
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Count   int                `json:"count"`
+		Results []nes.SearchResult `json:"results"`
+	}{count, results})
+}
+
+// watchValue is a watch with its current value
+type watchValue struct {
+	nes.Watch
+	Value int64 `json:"value"`
+}
+
+// watchHandler list the watches with their values as JSON, or change them
+// with a POST of action=add with address, size, signed and name,
+// action=remove with index, or action=import with list, a JSON export. GET
+// with export=1 downloads the list.
+func watchHandler(w http.ResponseWriter, r *http.Request) {
+	emu.Lock()
+	defer emu.Unlock()
+	if r.FormValue("export") != "" {
+		w.Header().Set("Content-Disposition", `attachment; filename="watches.json"`)
+		w.Header().Set("Content-Type", "application/json")
+		list := watches
+		if list == nil {
+			list = []nes.Watch{}
+		}
+		data, _ := json.MarshalIndent(list, "", "  ")
+		w.Write(data)
+		return
+	}
+	if r.Method == http.MethodPost {
+		index, _ := strconv.Atoi(r.FormValue("index"))
+		switch action := r.FormValue("action"); {
+		case action == "add":
+			watch, err := parseWatch(r.FormValue("address"), r.FormValue("size"), r.FormValue("signed"), r.FormValue("name"))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			watches = append(watches, watch)
+		case action == "import":
+			var list []nes.Watch
+			if err := json.Unmarshal([]byte(r.FormValue("list")), &list); err != nil {
+				http.Error(w, fmt.Sprintf("bad watch list: %v", err), http.StatusBadRequest)
+				return
+			}
+			for _, watch := range list {
+				if watch.Size != 1 && watch.Size != 2 {
+					http.Error(w, fmt.Sprintf("watch %q: size must be 1 or 2", watch.Name), http.StatusBadRequest)
+					return
+				}
+			}
+			watches = list
+		case index < 0 || index >= len(watches):
+			http.Error(w, fmt.Sprintf("no watch %q", r.FormValue("index")), http.StatusBadRequest)
+			return
+		case action == "remove":
+			watches = append(watches[:index], watches[index+1:]...)
+		default:
+			http.Error(w, fmt.Sprintf("unknown watch action %q", action), http.StatusBadRequest)
+			return
+		}
+	}
+	list := make([]watchValue, len(watches))
+	for i, watch := range watches {
+		list[i] = watchValue{watch, watch.Value(emu.console)}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// parseWatch check the fields of a new watch, the address in hex
+func parseWatch(address, size, signed, name string) (nes.Watch, error) {
+	a, err := strconv.ParseUint(address, 16, 16)
+	if err != nil {
+		return nes.Watch{}, fmt.Errorf("bad address %q", address)
+	}
+	n, _ := strconv.Atoi(size)
+	if n != 1 && n != 2 {
+		return nes.Watch{}, fmt.Errorf("size must be 1 or 2, not %q", size)
+	}
+	if name == "" {
+		name = fmt.Sprintf("%04X", a)
+	}
+	return nes.Watch{Address: uint16(a), Size: n, Signed: signed == "true", Name: name}, nil
+}
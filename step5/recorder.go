@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/lzw"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/shadow1163/nes-go/step5/nes"
+)
+
+// recorder writes every emulated frame, and its audio where the format
+// has room for it, to a video file
+type recorder interface {
+	frame(img *image.RGBA, samples []float32) error
+	close() error
+}
+
+// recordFormats are the file extensions newRecorder understands
+var recordFormats = []string{"gif", "apng", "y4m"}
+
+// recordingName returns the file name for a recording of a ROM started at
+// a frame, e.g. "Super Mario Bros-001234.gif"
+func recordingName(romFile string, frame int, format string) string {
+	return strings.TrimSuffix(screenshotName(romFile, frame), ".png") + "." + format
+}
+
+// newRecorder create a recorder for a console, picking the format from the
+// file extension: .gif, .apng or .png, .y4m. Y4M video goes with a WAV
+// file of the same name, or wavFile if set; "-" writes Y4M to stdout for
+// piping to an encoder, with audio only if wavFile is set.
+func newRecorder(filename, wavFile string, console *nes.Console) (recorder, error) {
+	frameRate := console.FrameRate()
+	ext := strings.ToLower(filepath.Ext(filename))
+	switch {
+	case filename == "-" || ext == ".y4m":
+		if wavFile == "" && filename != "-" {
+			wavFile = strings.TrimSuffix(filename, filepath.Ext(filename)) + ".wav"
+		}
+		return newY4MRecorder(filename, wavFile, frameRate)
+	case ext == ".gif":
+		return newGIFRecorder(filename, console.Palette(), frameRate)
+	case ext == ".apng" || ext == ".png":
+		return newAPNGRecorder(filename, frameRate)
+	}
+	return nil, fmt.Errorf("unknown recording format %q, want .gif, .apng or .y4m", ext)
+}
+
+// gifRecorder writes an animated GIF frame by frame, so long recordings
+// take no more memory than short ones. GIF delays are in 1/100s and most
+// viewers slow down frames shorter than 2/100s, so frames are dropped to
+// keep every delay at 2 or more while staying in time. A frame is written
+// once the next one is shown, when its delay is known.
+type gifRecorder struct {
+	file      *os.File
+	w         *bufio.Writer
+	palette   color.Palette
+	index     map[color.RGBA]uint8
+	frameTime float64 // 1/100s per frame
+	frames    int
+	written   int
+	shownTo   int // end of the shown frames, in 1/100s
+	pending   *image.Paletted
+}
+
+func newGIFRecorder(filename string, palette color.Palette, frameRate float64) (*gifRecorder, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	index := map[color.RGBA]uint8{}
+	for i := len(palette) - 1; i >= 0; i-- {
+		index[color.RGBAModel.Convert(palette[i]).(color.RGBA)] = uint8(i)
+	}
+	return &gifRecorder{file: file, w: bufio.NewWriter(file), palette: palette, index: index,
+		frameTime: 100 / frameRate}, nil
+}
+
+func (r *gifRecorder) frame(img *image.RGBA, samples []float32) error {
+	now := int(math.Round(float64(r.frames) * r.frameTime))
+	r.frames++
+	if r.pending != nil {
+		if now-r.shownTo < 2 {
+			return nil
+		}
+		if err := r.flush(now - r.shownTo); err != nil {
+			return err
+		}
+	}
+	r.pending = image.NewPaletted(img.Rect, r.palette)
+	for i := 0; i < len(img.Pix); i += 4 {
+		c := color.RGBA{img.Pix[i], img.Pix[i+1], img.Pix[i+2], 0xFF}
+		index, ok := r.index[c]
+		if !ok {
+			index = uint8(r.palette.Index(c))
+			r.index[c] = index
+		}
+		r.pending.Pix[i/4] = index
+	}
+	return nil
+}
+
+// colorBits returns the bits per pixel of the palette, 2 to 8 as LZW
+// needs at least 2
+func (r *gifRecorder) colorBits() int {
+	bits := 2
+	for 1<<uint(bits) < len(r.palette) && bits < 8 {
+		bits++
+	}
+	return bits
+}
+
+// writeHeader write the GIF header, the global palette and the looping
+// extension
+func (r *gifRecorder) writeHeader(bounds image.Rectangle) {
+	bits := r.colorBits()
+	w := r.w
+	w.WriteString("GIF89a")
+	binary.Write(w, binary.LittleEndian, [2]uint16{uint16(bounds.Dx()), uint16(bounds.Dy())})
+	w.Write([]byte{0x80 | 0x70 | byte(bits-1), 0, 0})
+	for i := 0; i < 1<<uint(bits); i++ {
+		var c color.RGBA
+		if i < len(r.palette) {
+			c = color.RGBAModel.Convert(r.palette[i]).(color.RGBA)
+		}
+		w.Write([]byte{c.R, c.G, c.B})
+	}
+	// loop forever
+	w.Write([]byte{0x21, 0xFF, 0x0B})
+	w.WriteString("NETSCAPE2.0")
+	w.Write([]byte{0x03, 0x01, 0x00, 0x00, 0x00})
+}
+
+// flush write the pending frame, shown for delay 1/100s
+func (r *gifRecorder) flush(delay int) error {
+	bounds := r.pending.Rect
+	if r.written == 0 {
+		r.writeHeader(bounds)
+	}
+	bits := r.colorBits()
+	w := r.w
+	w.Write([]byte{0x21, 0xF9, 0x04, 0x00, byte(delay), byte(delay >> 8), 0x00, 0x00})
+	w.WriteByte(0x2C)
+	binary.Write(w, binary.LittleEndian, [4]uint16{0, 0, uint16(bounds.Dx()), uint16(bounds.Dy())})
+	w.Write([]byte{0x00, byte(bits)})
+	blocks := &gifBlockWriter{w: w}
+	lzwWriter := lzw.NewWriter(blocks, lzw.LSB, bits)
+	if _, err := lzwWriter.Write(r.pending.Pix); err != nil {
+		return err
+	}
+	if err := lzwWriter.Close(); err != nil {
+		return err
+	}
+	if err := blocks.close(); err != nil {
+		return err
+	}
+	r.written++
+	r.shownTo += delay
+	return nil
+}
+
+func (r *gifRecorder) close() error {
+	if r.pending != nil {
+		end := int(math.Round(float64(r.frames) * r.frameTime))
+		if end-r.shownTo < 2 {
+			end = r.shownTo + 2
+		}
+		if err := r.flush(end - r.shownTo); err != nil {
+			r.file.Close()
+			return err
+		}
+	}
+	if r.written == 0 {
+		r.file.Close()
+		return fmt.Errorf("%s: no frames recorded", r.file.Name())
+	}
+	r.w.WriteByte(0x3B)
+	if err := r.w.Flush(); err != nil {
+		r.file.Close()
+		return err
+	}
+	return r.file.Close()
+}
+
+// gifBlockWriter splits the LZW data of a frame into the sub-blocks of at
+// most 255 bytes a GIF stores it in
+type gifBlockWriter struct {
+	w   *bufio.Writer
+	buf [255]byte
+	n   int
+}
+
+func (b *gifBlockWriter) Write(p []byte) (int, error) {
+	written := len(p)
+	for len(p) > 0 {
+		n := copy(b.buf[b.n:], p)
+		b.n += n
+		p = p[n:]
+		if b.n == len(b.buf) {
+			if err := b.flush(); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (b *gifBlockWriter) flush() error {
+	if b.n == 0 {
+		return nil
+	}
+	b.w.WriteByte(byte(b.n))
+	_, err := b.w.Write(b.buf[:b.n])
+	b.n = 0
+	return err
+}
+
+// close write the last sub-block and the terminator
+func (b *gifBlockWriter) close() error {
+	if err := b.flush(); err != nil {
+		return err
+	}
+	return b.w.WriteByte(0)
+}
+
+// apngRecorder writes an animated PNG frame by frame. The frame count in
+// the acTL chunk is unknown until the end, so it is patched on close.
+//
+// https://wiki.mozilla.org/APNG_Specification
+type apngRecorder struct {
+	file      *os.File
+	w         *bufio.Writer
+	delayDen  uint16 // frame delay is 1000/delayDen s
+	frames    uint32
+	sequence  uint32
+	actlStart int64
+	raw       bytes.Buffer
+	zbuf      bytes.Buffer
+}
+
+func newAPNGRecorder(filename string, frameRate float64) (*apngRecorder, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	r := &apngRecorder{file: file, w: bufio.NewWriter(file), delayDen: uint16(math.Round(frameRate * 1000))}
+	r.w.WriteString("\x89PNG\r\n\x1a\n")
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], 256)
+	binary.BigEndian.PutUint32(ihdr[4:], 240)
+	ihdr[8] = 8 // bit depth
+	ihdr[9] = 2 // RGB
+	r.chunk("IHDR", ihdr)
+	r.actlStart = 8 + 12 + 13
+	r.chunk("acTL", make([]byte, 8))
+	return r, nil
+}
+
+// chunk write a PNG chunk
+func (r *apngRecorder) chunk(name string, data []byte) {
+	var head [8]byte
+	binary.BigEndian.PutUint32(head[:], uint32(len(data)))
+	copy(head[4:], name)
+	crc := crc32.NewIEEE()
+	crc.Write(head[4:])
+	crc.Write(data)
+	r.w.Write(head[:])
+	r.w.Write(data)
+	binary.Write(r.w, binary.BigEndian, crc.Sum32())
+}
+
+func (r *apngRecorder) frame(img *image.RGBA, samples []float32) error {
+	fctl := make([]byte, 26)
+	binary.BigEndian.PutUint32(fctl[0:], r.sequence)
+	binary.BigEndian.PutUint32(fctl[4:], uint32(img.Rect.Dx()))
+	binary.BigEndian.PutUint32(fctl[8:], uint32(img.Rect.Dy()))
+	binary.BigEndian.PutUint16(fctl[20:], 1000)
+	binary.BigEndian.PutUint16(fctl[22:], r.delayDen)
+	r.chunk("fcTL", fctl)
+	r.sequence++
+
+	// every scanline is stored unfiltered
+	r.raw.Reset()
+	for y := 0; y < img.Rect.Dy(); y++ {
+		r.raw.WriteByte(0)
+		row := img.Pix[y*img.Stride : y*img.Stride+img.Rect.Dx()*4]
+		for x := 0; x < len(row); x += 4 {
+			r.raw.Write(row[x : x+3])
+		}
+	}
+	r.zbuf.Reset()
+	if r.frames > 0 {
+		binary.Write(&r.zbuf, binary.BigEndian, r.sequence)
+		r.sequence++
+	}
+	z := zlib.NewWriter(&r.zbuf)
+	z.Write(r.raw.Bytes())
+	z.Close()
+	if r.frames == 0 {
+		r.chunk("IDAT", r.zbuf.Bytes())
+	} else {
+		r.chunk("fdAT", r.zbuf.Bytes())
+	}
+	r.frames++
+	return r.w.Flush()
+}
+
+func (r *apngRecorder) close() error {
+	r.chunk("IEND", nil)
+	err := r.w.Flush()
+	if err == nil {
+		_, err = r.file.Seek(r.actlStart, io.SeekStart)
+	}
+	if err == nil {
+		actl := make([]byte, 8) // frame count, then 0 to loop forever
+		binary.BigEndian.PutUint32(actl, r.frames)
+		r.chunk("acTL", actl)
+		err = r.w.Flush()
+	}
+	if cerr := r.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// y4mRecorder writes raw YUV 4:4:4 video, and 16 bit mono PCM audio to a
+// separate WAV file, both meant to be fed to an external encoder
+type y4mRecorder struct {
+	video     io.WriteCloser
+	w         *bufio.Writer
+	yuv       []byte
+	wav       *os.File
+	wavW      *bufio.Writer
+	wavBytes  uint32
+	header    bool
+	frameRate float64
+}
+
+func newY4MRecorder(filename, wavFile string, frameRate float64) (*y4mRecorder, error) {
+	r := &y4mRecorder{frameRate: frameRate}
+	if filename == "-" {
+		r.video = os.Stdout
+	} else {
+		file, err := os.Create(filename)
+		if err != nil {
+			return nil, err
+		}
+		r.video = file
+	}
+	r.w = bufio.NewWriter(r.video)
+	if wavFile != "" {
+		wav, err := os.Create(wavFile)
+		if err != nil {
+			r.video.Close()
+			return nil, err
+		}
+		r.wav = wav
+		r.wavW = bufio.NewWriter(wav)
+		// The sizes are unknown until the end, a reader of a pipe sees
+		// the largest possible ones.
+		r.writeWAVHeader(r.wavW, 0xFFFFFFFF-36)
+	}
+	return r, nil
+}
+
+// writeWAVHeader write a 16 bit mono PCM header for dataBytes of samples
+func (r *y4mRecorder) writeWAVHeader(w io.Writer, dataBytes uint32) {
+	header := struct {
+		RIFF          [4]byte
+		Size          uint32
+		WAVE, Fmt     [4]byte
+		FmtSize       uint32
+		Format        uint16
+		Channels      uint16
+		SampleRate    uint32
+		ByteRate      uint32
+		BlockAlign    uint16
+		BitsPerSample uint16
+		Data          [4]byte
+		DataSize      uint32
+	}{
+		[4]byte{'R', 'I', 'F', 'F'}, 36 + dataBytes,
+		[4]byte{'W', 'A', 'V', 'E'}, [4]byte{'f', 'm', 't', ' '},
+		16, 1, 1, nes.SampleRate, nes.SampleRate * 2, 2, 16,
+		[4]byte{'d', 'a', 't', 'a'}, dataBytes,
+	}
+	binary.Write(w, binary.LittleEndian, header)
+}
+
+func (r *y4mRecorder) frame(img *image.RGBA, samples []float32) error {
+	width, height := img.Rect.Dx(), img.Rect.Dy()
+	if !r.header {
+		fmt.Fprintf(r.w, "YUV4MPEG2 W%d H%d F%d:1000 Ip A1:1 C444 XCOLORRANGE=FULL\n",
+			width, height, int(math.Round(r.frameRate*1000)))
+		r.yuv = make([]byte, width*height*3)
+		r.header = true
+	}
+	n := width * height
+	for i := 0; i < n; i++ {
+		p := img.Pix[i*4:]
+		r.yuv[i], r.yuv[n+i], r.yuv[2*n+i] = color.RGBToYCbCr(p[0], p[1], p[2])
+	}
+	r.w.WriteString("FRAME\n")
+	if _, err := r.w.Write(r.yuv); err != nil {
+		return err
+	}
+	if r.wav != nil {
+		for _, s := range samples {
+			binary.Write(r.wavW, binary.LittleEndian, int16(s*math.MaxInt16))
+		}
+		r.wavBytes += uint32(len(samples) * 2)
+	}
+	return nil
+}
+
+func (r *y4mRecorder) close() error {
+	err := r.w.Flush()
+	if r.video != os.Stdout {
+		if cerr := r.video.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if r.wav == nil {
+		return err
+	}
+	if werr := r.wavW.Flush(); err == nil {
+		err = werr
+	}
+	// fix the sizes up when the WAV is a file rather than a pipe
+	if _, serr := r.wav.Seek(0, io.SeekStart); serr == nil {
+		r.writeWAVHeader(r.wav, r.wavBytes)
+	}
+	if cerr := r.wav.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// record start or stop a recording: action=start with format=gif, apng or
+// y4m, or action=stop. Recordings are saved in the screenshot dir.
+func record(w http.ResponseWriter, r *http.Request) {
+	emu.Lock()
+	defer emu.Unlock()
+	switch r.FormValue("action") {
+	case "start":
+		format := r.FormValue("format")
+		if format == "" {
+			format = recordFormat
+		}
+		known := false
+		for _, f := range recordFormats {
+			known = known || f == format
+		}
+		if !known {
+			http.Error(w, fmt.Sprintf("unknown format %q", format), http.StatusBadRequest)
+			return
+		}
+		filename := filepath.Join(screenshotDir, recordingName(romPath, emu.console.Frame, format))
+		if err := emu.startRecording(filename); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		fmt.Fprintf(w, "recording to %s", filename)
+	case "stop":
+		if err := emu.stopRecording(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprint(w, "stopped")
+	default:
+		http.Error(w, fmt.Sprintf("unknown record action %q", r.FormValue("action")), http.StatusBadRequest)
+	}
+}
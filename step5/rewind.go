@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+)
+
+// rewindBuffer holds the recent save states, oldest first, within a
+// memory limit. Only the newest state is kept whole; every older one is
+// stored as its XOR with the next newer state, deflated. Consecutive
+// states differ in few bytes so the deltas compress well, and dropping the
+// oldest entry never breaks the chain.
+type rewindBuffer struct {
+	interval   int // frames between two states
+	maxStates  int
+	limit      int // bytes
+	deltas     [][]byte
+	deltaBytes int
+	latest     []byte
+}
+
+// newRewindBuffer keep seconds of play, a state every interval frames, in
+// at most limit bytes
+func newRewindBuffer(seconds float64, frameRate float64, interval int, limit int) *rewindBuffer {
+	if interval < 1 {
+		interval = 1
+	}
+	return &rewindBuffer{
+		interval:  interval,
+		maxStates: int(seconds*frameRate) / interval,
+		limit:     limit,
+	}
+}
+
+// push add the newest state, which is not copied
+func (b *rewindBuffer) push(state []byte) {
+	if b.latest != nil {
+		if len(b.latest) == len(state) {
+			delta := compressDelta(b.latest, state)
+			b.deltas = append(b.deltas, delta)
+			b.deltaBytes += len(delta)
+		} else {
+			b.clear()
+		}
+	}
+	b.latest = state
+	for len(b.deltas) > 0 && (len(b.deltas)+1 > b.maxStates || b.deltaBytes+len(b.latest) > b.limit) {
+		b.deltaBytes -= len(b.deltas[0])
+		b.deltas[0] = nil
+		b.deltas = b.deltas[1:]
+	}
+}
+
+// pop remove and return the newest state. The oldest state is returned
+// but kept, so rewinding stops there.
+func (b *rewindBuffer) pop() []byte {
+	state := b.latest
+	if len(b.deltas) == 0 {
+		return state
+	}
+	last := len(b.deltas) - 1
+	previous, err := expandDelta(b.deltas[last], state)
+	if err != nil {
+		// cannot happen with deltas we compressed ourselves
+		log.Error(err)
+		b.clear()
+		b.latest = state
+		return state
+	}
+	b.deltaBytes -= len(b.deltas[last])
+	b.deltas = b.deltas[:last]
+	b.latest = previous
+	return state
+}
+
+// len returns the number of states held
+func (b *rewindBuffer) len() int {
+	if b.latest == nil {
+		return 0
+	}
+	return len(b.deltas) + 1
+}
+
+func (b *rewindBuffer) clear() {
+	b.deltas = nil
+	b.deltaBytes = 0
+	b.latest = nil
+}
+
+// compressDelta deflate older XOR newer
+func compressDelta(older, newer []byte) []byte {
+	xor := make([]byte, len(older))
+	for i := range xor {
+		xor[i] = older[i] ^ newer[i]
+	}
+	var buf bytes.Buffer
+	w, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	w.Write(xor)
+	w.Close()
+	return buf.Bytes()
+}
+
+// expandDelta recover the older state from a delta and the newer state
+func expandDelta(delta, newer []byte) ([]byte, error) {
+	older := make([]byte, len(newer))
+	if _, err := io.ReadFull(flate.NewReader(bytes.NewReader(delta)), older); err != nil {
+		return nil, err
+	}
+	for i := range older {
+		older[i] ^= newer[i]
+	}
+	return older, nil
+}
+
+// rewind control rewinding: action=start keeps stepping back one state
+// per frame until action=stop, steps=N goes back N states at once
+func rewind(w http.ResponseWriter, r *http.Request) {
+	emu.Lock()
+	defer emu.Unlock()
+	if emu.rewind == nil {
+		http.Error(w, "rewind is disabled", http.StatusConflict)
+		return
+	}
+	switch r.FormValue("action") {
+	case "start":
+		emu.rewinding = true
+	case "stop":
+		emu.rewinding = false
+	case "":
+		steps, err := strconv.Atoi(r.FormValue("steps"))
+		if err != nil || steps < 1 {
+			http.Error(w, "steps must be a positive number", http.StatusBadRequest)
+			return
+		}
+		for i := 0; i < steps; i++ {
+			if err := emu.rewindStep(); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+	default:
+		http.Error(w, fmt.Sprintf("unknown rewind action %q", r.FormValue("action")), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprintf(w, "frame %d, %d states", emu.console.Frame, emu.rewind.len())
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// overscan is how many lines at the top and bottom of the frame a TV hides
+const overscan = 8
+
+// screenshotImage crop and scale a frame for saving. Scaling is nearest
+// neighbour by a whole factor so the pixels stay sharp.
+func screenshotImage(frame *image.RGBA, scale int, crop bool) *image.RGBA {
+	bounds := frame.Bounds()
+	if crop {
+		bounds.Min.Y += overscan
+		bounds.Max.Y -= overscan
+	}
+	if scale < 1 {
+		scale = 1
+	}
+	img := image.NewRGBA(image.Rect(0, 0, bounds.Dx()*scale, bounds.Dy()*scale))
+	for y := 0; y < img.Rect.Dy(); y++ {
+		for x := 0; x < img.Rect.Dx(); x++ {
+			img.SetRGBA(x, y, frame.RGBAAt(bounds.Min.X+x/scale, bounds.Min.Y+y/scale))
+		}
+	}
+	return img
+}
+
+// screenshotName returns the file name for a screenshot of a ROM at a
+// frame, e.g. "Super Mario Bros-001234.png"
+func screenshotName(romFile string, frame int) string {
+	name := strings.TrimSuffix(filepath.Base(romFile), filepath.Ext(romFile))
+	return fmt.Sprintf("%s-%06d.png", name, frame)
+}
+
+// writePNG save an image as a PNG file
+func writePNG(filename string, img image.Image) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(file, img); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// saveScreenshot save the latest frame to the screenshot dir
+func saveScreenshot() {
+	frame, n := emu.frames.last()
+	if frame == nil {
+		return
+	}
+	filename := filepath.Join(screenshotDir, screenshotName(romPath, n))
+	img := screenshotImage(frame, screenshotScale, screenshotCrop)
+	if err := writePNG(filename, img); err != nil {
+		log.Error(err)
+		return
+	}
+	log.Info("saved " + filename)
+}
+
+// screenshot serve the latest frame as a PNG download. The query sets
+// scale=N and crop=1, defaulting to the command line flags.
+func screenshot(w http.ResponseWriter, r *http.Request) {
+	frame, n := emu.frames.last()
+	if frame == nil {
+		http.Error(w, "no frame yet", http.StatusServiceUnavailable)
+		return
+	}
+	scale, crop := screenshotScale, screenshotCrop
+	var err error
+	if s := r.FormValue("scale"); s != "" {
+		if scale, err = strconv.Atoi(s); err != nil || scale < 1 || scale > 8 {
+			http.Error(w, "scale must be 1 to 8", http.StatusBadRequest)
+			return
+		}
+	}
+	if s := r.FormValue("crop"); s != "" {
+		if crop, err = strconv.ParseBool(s); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", screenshotName(romPath, n)))
+	w.Header().Set("Cache-Control", "no-cache")
+	png.Encode(w, screenshotImage(frame, scale, crop))
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/websocket"
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 256 * 240 * 4,
+}
+
+// socketMessage is an event sent by the page over the frame socket
+type socketMessage struct {
+	Type    string `json:"type"` // "key" or "pad"
+	Code    int    `json:"code"`
+	Down    bool   `json:"down"`
+	Player  int    `json:"player"`
+	Buttons int    `json:"buttons"`
+}
+
+// frameSocket stream frames to the page as raw 256x240 RGBA binary
+// messages as soon as the emulation produces them. The page sends its
+// input over the same socket.
+func frameSocket(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	done := make(chan bool)
+	go readSocket(conn, done)
+
+	frames := emu.frames.subscribe()
+	defer emu.frames.unsubscribe(frames)
+	for {
+		select {
+		case frame := <-frames:
+			if err := conn.WriteMessage(websocket.BinaryMessage, frame.Pix); err != nil {
+				log.Debug(err)
+				return
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// readSocket handle input events from the page until the socket closes
+func readSocket(conn *websocket.Conn, done chan bool) {
+	defer close(done)
+	for {
+		_, data, err := conn.ReadMessage()
+		if err != nil {
+			log.Debug(err)
+			return
+		}
+		var msg socketMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			log.Warning(err)
+			continue
+		}
+		switch msg.Type {
+		case "key":
+			handleKey(msg.Code, msg.Down)
+		case "pad":
+			if msg.Player == 0 || msg.Player == 1 {
+				keys.gamepad(msg.Player, msg.Buttons)
+			}
+		}
+	}
+}
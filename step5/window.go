@@ -0,0 +1,13 @@
+//go:build !nowebview
+
+package main
+
+import "github.com/zserge/webview"
+
+// openWindow show the user interface in a native window and returns once
+// it is closed. Build with -tags nowebview for a binary that needs no GTK
+// or WebKit libraries, for "nes run" and "nes disasm" on machines without
+// a display.
+func openWindow(url string) error {
+	return webview.Open("nes step5", url, 600, 400, false)
+}
@@ -0,0 +1,11 @@
+//go:build nowebview
+
+package main
+
+// openWindow print where to point a browser at the user interface and wait
+// for the process to be interrupted, as there is no native window in a
+// nowebview build
+func openWindow(url string) error {
+	log.Info("open " + url + " in a browser")
+	select {}
+}